@@ -0,0 +1,185 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+type blockResponse int
+
+// block responses
+const (
+	blockNXDomain blockResponse = iota // NXDOMAIN with a SOA, the default response
+	blockNoData                        // empty NOERROR with a SOA
+	blockRefused                       // REFUSED
+	blockNull                          // 0.0.0.0 or ::
+	blockSinkhole                      // custom IPs
+)
+
+var blockResponseNames = map[string]blockResponse{
+	"":         blockNXDomain,
+	"nxdomain": blockNXDomain,
+	"nodata":   blockNoData,
+	"refused":  blockRefused,
+	"null":     blockNull,
+	"sinkhole": blockSinkhole,
+}
+
+const defaultBlockTTL = 300
+
+// blocklist is a list of blocked domains. Matched queries are
+// answered directly.
+type blocklist struct {
+	hits uint64 // atomic, keep it first for 64-bit alignment
+
+	name     string
+	domains  *domainList
+	response blockResponse
+	ips      []net.IP // for blockSinkhole
+	ttl      uint32
+}
+
+func newBlocklist(name string, conf *BlocklistConfig, w *listWatcher) (*blocklist, error) {
+	b := &blocklist{name: name, ttl: defaultBlockTTL}
+	if conf.TTL > 0 {
+		b.ttl = uint32(conf.TTL)
+	}
+
+	if len(conf.List) == 0 {
+		return nil, errors.New("missing list")
+	}
+	l, err := w.domainList(name, conf.List)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load list, %w", err)
+	}
+	b.domains = l
+
+	response, ok := blockResponseNames[strings.ToLower(conf.Response)]
+	if !ok {
+		return nil, fmt.Errorf("invalid response [%s]", conf.Response)
+	}
+	b.response = response
+
+	if response == blockSinkhole {
+		if len(conf.SinkholeIP) == 0 {
+			return nil, errors.New("missing sinkhole_ip")
+		}
+		for _, s := range conf.SinkholeIP {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid sinkhole ip [%s]", s)
+			}
+			b.ips = append(b.ips, ip)
+		}
+	}
+	return b, nil
+}
+
+// matchBlocklist returns the first blocklist that q matches, or nil.
+// Domains in the allowlist are never blocked.
+func (d *dispatcher) matchBlocklist(q *dns.Msg) *blocklist {
+	if len(d.blocklists) == 0 || len(q.Question) != 1 {
+		return nil
+	}
+	name := q.Question[0].Name
+	if d.allowlist != nil && d.allowlist.Has(name) {
+		return nil
+	}
+	for _, b := range d.blocklists {
+		if b.domains.Has(name) {
+			atomic.AddUint64(&b.hits, 1)
+			return b
+		}
+	}
+	return nil
+}
+
+// reply returns the block response of q.
+func (b *blocklist) reply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	question := q.Question[0]
+
+	switch b.response {
+	case blockRefused:
+		r.SetRcode(q, dns.RcodeRefused)
+		return r
+	case blockNXDomain:
+		r.SetRcode(q, dns.RcodeNameError)
+		r.Ns = []dns.RR{b.soa(question.Name)}
+		return r
+	case blockNoData:
+		r.SetReply(q)
+		r.Ns = []dns.RR{b.soa(question.Name)}
+		return r
+	}
+
+	ips := b.ips
+	if b.response == blockNull {
+		ips = []net.IP{net.IPv4zero, net.IPv6zero}
+	}
+	r.SetReply(q)
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: b.ttl}
+		switch ip4 := ip.To4(); {
+		case ip4 != nil && question.Qtype == dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case ip4 == nil && question.Qtype == dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(r.Answer) == 0 {
+		r.Ns = []dns.RR{b.soa(question.Name)}
+	}
+	return r
+}
+
+// soa returns a fake SOA record so that clients cache the
+// negative response for ttl, as defined in RFC 2308.
+func (b *blocklist) soa(name string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: b.ttl},
+		Ns:      "blocked.mos-chinadns.",
+		Mbox:    "blocked.mos-chinadns.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  b.ttl,
+	}
+}
+
+// writeBlocklistHits writes the hit counters of blocklists to w.
+func (d *dispatcher) writeBlocklistHits(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# list\tentries\thits\n")
+	for _, b := range d.blocklists {
+		fmt.Fprintf(bw, "%s\t%d\t%d\n", b.name, b.domains.Len(), atomic.LoadUint64(&b.hits))
+	}
+	return bw.Flush()
+}
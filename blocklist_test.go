@@ -0,0 +1,94 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+func Test_blocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("ads.com\ntracker.com\n")
+	f.Close()
+
+	d := &dispatcher{entry: logrus.NewEntry(logrus.StandardLogger())}
+	for _, bc := range []*BlocklistConfig{
+		{Name: "nx", List: StringList{f.Name()}, TTL: 60},
+		{Name: "sinkhole", List: StringList{f.Name()}, Response: "sinkhole", SinkholeIP: []string{"10.0.0.1"}},
+	} {
+		b, err := newBlocklist(bc.Name, bc, newListWatcher(d.entry, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.blocklists = append(d.blocklists, b)
+	}
+	allowlist := domainlist.New()
+	allowlist.Add("ok.ads.com")
+	d.allowlist = newDomainList(allowlist)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.ads.com.", dns.TypeA)
+	b := d.matchBlocklist(q)
+	if b == nil || b.name != "nx" {
+		t.Fatal("www.ads.com should be blocked by nx")
+	}
+	r := b.reply(q)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].(*dns.SOA).Minttl != 60 {
+		t.Fatal("invalid NXDOMAIN response")
+	}
+
+	q.SetQuestion("ok.ads.com.", dns.TypeA)
+	if d.matchBlocklist(q) != nil {
+		t.Fatal("allowlist should override blocklists")
+	}
+
+	for response, check := range map[string]func(r *dns.Msg) bool{
+		"nodata":  func(r *dns.Msg) bool { return r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0 && len(r.Ns) == 1 },
+		"refused": func(r *dns.Msg) bool { return r.Rcode == dns.RcodeRefused },
+		"null":    func(r *dns.Msg) bool { return len(r.Answer) == 1 && r.Answer[0].(*dns.A).A.Equal(net.IPv4zero) },
+		"sinkhole": func(r *dns.Msg) bool {
+			return len(r.Answer) == 1 && r.Answer[0].(*dns.A).A.Equal(net.IPv4(10, 0, 0, 1))
+		},
+	} {
+		b := &blocklist{ttl: defaultBlockTTL, response: blockResponseNames[response], ips: []net.IP{net.IPv4(10, 0, 0, 1)}}
+		q.SetQuestion("ads.com.", dns.TypeA)
+		if !check(b.reply(q)) {
+			t.Fatalf("invalid %s response", response)
+		}
+	}
+
+	q.SetQuestion("tracker.com.", dns.TypeA)
+	d.matchBlocklist(q)
+	buf := new(strings.Builder)
+	d.writeBlocklistHits(buf)
+	if !strings.Contains(buf.String(), "nx\t2\t2\n") {
+		t.Fatalf("invalid hit counters: %s", buf.String())
+	}
+}
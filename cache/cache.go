@@ -0,0 +1,180 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache is a simple in-memory dns response cache. It is safe for concurrent use.
+type Cache struct {
+	size int
+
+	sync.RWMutex
+	m map[string]*elem
+}
+
+type elem struct {
+	r              *dns.Msg
+	storedTime     time.Time
+	expirationTime time.Time
+}
+
+// New returns a Cache that holds at most size responses.
+func New(size int) *Cache {
+	return &Cache{
+		size: size,
+		m:    make(map[string]*elem, size),
+	}
+}
+
+// Add adds a copy of r to the cache. r will expire after ttl.
+func (c *Cache) Add(key string, ttl time.Duration, r *dns.Msg) {
+	if ttl <= 0 || c.size <= 0 {
+		return
+	}
+	now := time.Now()
+	c.add(key, &elem{r: r.Copy(), storedTime: now, expirationTime: now.Add(ttl)})
+}
+
+func (c *Cache) add(key string, e *elem) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.m[key]; !ok && len(c.m) >= c.size {
+		c.evict()
+	}
+	c.m[key] = e
+}
+
+// evict removes expired elems. If the cache is still full, it removes
+// some random elems. Caller must hold the lock.
+func (c *Cache) evict() {
+	now := time.Now()
+	for key, e := range c.m {
+		if now.After(e.expirationTime) {
+			delete(c.m, key)
+		}
+	}
+
+	// remove 1/8 of the cache
+	toRemove := len(c.m) - c.size + c.size/8 + 1
+	for key := range c.m {
+		if toRemove <= 0 {
+			break
+		}
+		delete(c.m, key)
+		toRemove--
+	}
+}
+
+// Get returns a copy of the cached response. The TTLs of its records
+// are reduced by the time it has spent in the cache.
+// If key is not in the cache or has expired, Get returns nil.
+func (c *Cache) Get(key string) *dns.Msg {
+	c.RLock()
+	e, ok := c.m[key]
+	c.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(e.expirationTime) {
+		c.Lock()
+		if c.m[key] == e {
+			delete(c.m, key)
+		}
+		c.Unlock()
+		return nil
+	}
+
+	r := e.r.Copy()
+	subtractTTL(r, uint32(now.Sub(e.storedTime)/time.Second))
+	return r
+}
+
+// Len returns the number of responses in the cache, including expired ones.
+func (c *Cache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m)
+}
+
+func subtractTTL(r *dns.Msg, d uint32) {
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > d {
+				hdr.Ttl = hdr.Ttl - d
+			} else {
+				hdr.Ttl = 1
+			}
+		}
+	}
+}
+
+// MinTTL returns the minimum ttl of the records in r, OPT records are ignored.
+// If r has no record, MinTTL returns 0.
+func MinTTL(r *dns.Msg) uint32 {
+	var minTTL uint32
+	var found bool
+	for _, section := range [...][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || hdr.Ttl < minTTL {
+				minTTL = hdr.Ttl
+				found = true
+			}
+		}
+	}
+	return minTTL
+}
+
+// NegativeTTL returns the ttl of a negative response (NXDOMAIN or NODATA)
+// as defined in RFC 2308 section 5, which is the minimum of the SOA record's
+// TTL and its MINIMUM field. If r is not a negative response or has no SOA
+// record in its authority section, ok will be false.
+func NegativeTTL(r *dns.Msg) (ttl uint32, ok bool) {
+	switch {
+	case r.Rcode == dns.RcodeNameError:
+	case r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0:
+	default:
+		return 0, false
+	}
+
+	for _, rr := range r.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
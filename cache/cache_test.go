@@ -0,0 +1,133 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestMsg(name string, ttl uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	return r
+}
+
+func Test_Cache(t *testing.T) {
+	c := New(16)
+	c.Add("a", time.Minute, newTestMsg("a.com", 60))
+	c.Add("expired", time.Nanosecond, newTestMsg("b.com", 60))
+	time.Sleep(time.Millisecond)
+
+	if r := c.Get("a"); r == nil || r.Answer[0].Header().Name != "a.com." {
+		t.Fatal("cached response not found")
+	}
+	if r := c.Get("expired"); r != nil {
+		t.Fatal("expired response returned")
+	}
+	if r := c.Get("unknown"); r != nil {
+		t.Fatal("unknown key returned a response")
+	}
+
+	// cache should not grow beyond its size
+	for i := 0; i < 64; i++ {
+		c.Add(string(rune('A'+i)), time.Minute, newTestMsg("a.com", 60))
+	}
+	if c.Len() > 16 {
+		t.Fatalf("cache size %d exceeded limit", c.Len())
+	}
+}
+
+func Test_Cache_DumpLoad(t *testing.T) {
+	c := New(16)
+	r := newTestMsg("a.com", 60)
+	c.add("a", &elem{r: r, storedTime: time.Now().Add(-time.Second * 10), expirationTime: time.Now().Add(time.Second * 50)})
+	c.add("expired", &elem{r: r, storedTime: time.Now().Add(-time.Minute), expirationTime: time.Now().Add(-time.Second)})
+
+	buf := new(bytes.Buffer)
+	if _, err := c.Dump(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := New(16)
+	n, err := c2.Load(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 response loaded, got %d", n)
+	}
+	got := c2.Get("a")
+	if got == nil {
+		t.Fatal("loaded response not found")
+	}
+	// ttl should be adjusted for the elapsed time
+	if ttl := got.Answer[0].Header().Ttl; ttl > 50 || ttl < 49 {
+		t.Fatalf("unexpected ttl %d", ttl)
+	}
+
+	// incompatible version
+	b := buf.Bytes()
+	b[len(dumpMagic)+1]++
+	if _, err := New(16).Load(bytes.NewReader(b)); err != ErrIncompatibleDump {
+		t.Fatalf("want ErrIncompatibleDump, got %v", err)
+	}
+}
+
+func Test_NegativeTTL(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+		Ns:     "a.gtld-servers.net.",
+		Mbox:   "nstld.verisign-grs.com.",
+		Minttl: 300,
+	}
+
+	nx := new(dns.Msg)
+	nx.SetQuestion("nx.com.", dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+	nx.Ns = []dns.RR{soa}
+	if ttl, ok := NegativeTTL(nx); !ok || ttl != 300 {
+		t.Fatalf("NXDOMAIN: want 300, got %d %v", ttl, ok)
+	}
+
+	nodata := new(dns.Msg)
+	nodata.SetQuestion("a.com.", dns.TypeAAAA)
+	soa.Minttl = 3600
+	nodata.Ns = []dns.RR{soa}
+	if ttl, ok := NegativeTTL(nodata); !ok || ttl != 900 {
+		t.Fatalf("NODATA: want 900, got %d %v", ttl, ok)
+	}
+
+	// no SOA, should not be cached
+	nodata.Ns = nil
+	if _, ok := NegativeTTL(nodata); ok {
+		t.Fatal("negative response without SOA should not be cached")
+	}
+
+	if _, ok := NegativeTTL(newTestMsg("a.com", 60)); ok {
+		t.Fatal("positive response is not negative")
+	}
+}
@@ -0,0 +1,176 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dump file format (big endian):
+//
+//	header: magic [8]byte | version uint16
+//	record: key_len uint16 | key | stored_time int64 | expiration_time int64 | msg_len uint16 | msg
+//
+// Times are unix nanoseconds. Records are repeated until EOF.
+const (
+	dumpMagic   = "MOSCACHE"
+	dumpVersion = 1
+)
+
+// ErrIncompatibleDump is returned by Load if the dump was written in
+// another format or version.
+var ErrIncompatibleDump = errors.New("incompatible cache dump")
+
+// Dump writes all unexpired responses in the cache to w.
+// It returns the number of responses written.
+func (c *Cache) Dump(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(dumpMagic); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(bw, binary.BigEndian, uint16(dumpVersion)); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	buf := make([]byte, dns.MaxMsgSize)
+	n := 0
+
+	c.RLock()
+	defer c.RUnlock()
+	for key, e := range c.m {
+		if now.After(e.expirationTime) || len(key) > 0xffff {
+			continue
+		}
+		msg, err := e.r.PackBuffer(buf)
+		if err != nil {
+			continue
+		}
+
+		binary.Write(bw, binary.BigEndian, uint16(len(key)))
+		bw.WriteString(key)
+		binary.Write(bw, binary.BigEndian, e.storedTime.UnixNano())
+		binary.Write(bw, binary.BigEndian, e.expirationTime.UnixNano())
+		binary.Write(bw, binary.BigEndian, uint16(len(msg)))
+		if _, err := bw.Write(msg); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, bw.Flush()
+}
+
+// Load reads responses from a dump written by Dump and adds them to the cache.
+// Expired responses are discarded. It returns the number of responses loaded.
+func (c *Cache) Load(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != dumpMagic {
+		return 0, ErrIncompatibleDump
+	}
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil || version != dumpVersion {
+		return 0, ErrIncompatibleDump
+	}
+
+	now := time.Now()
+	n := 0
+	for {
+		var keyLen uint16
+		if err := binary.Read(br, binary.BigEndian, &keyLen); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return n, err
+		}
+		var storedTime, expirationTime int64
+		if err := binary.Read(br, binary.BigEndian, &storedTime); err != nil {
+			return n, err
+		}
+		if err := binary.Read(br, binary.BigEndian, &expirationTime); err != nil {
+			return n, err
+		}
+		var msgLen uint16
+		if err := binary.Read(br, binary.BigEndian, &msgLen); err != nil {
+			return n, err
+		}
+		msg := make([]byte, msgLen)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return n, err
+		}
+
+		e := &elem{
+			r:              new(dns.Msg),
+			storedTime:     time.Unix(0, storedTime),
+			expirationTime: time.Unix(0, expirationTime),
+		}
+		if now.After(e.expirationTime) {
+			continue
+		}
+		if err := e.r.Unpack(msg); err != nil {
+			return n, fmt.Errorf("invalid msg in record %d: %w", n, err)
+		}
+		c.add(string(key), e)
+		n++
+	}
+}
+
+// DumpToFile writes the cache to file. The file is replaced atomically.
+func (c *Cache) DumpToFile(file string) (int, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := c.Dump(tmp)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), file)
+}
+
+// LoadFromFile loads a dump file written by DumpToFile.
+func (c *Cache) LoadFromFile(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
@@ -0,0 +1,258 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	redisKeyPrefix    = "mos-chinadns:"
+	redisMaxIdleConns = 16
+	redisRetryDelay   = time.Second * 10
+)
+
+var errRedisNil = errors.New("redis: nil reply")
+
+// RedisCache is a dns response cache that stores responses in an external
+// server which speaks the redis protocol, so it can be shared by multiple
+// instances. If the server is unreachable, RedisCache falls back to an
+// in-process Cache and retries the server later.
+type RedisCache struct {
+	// atomic, keep it first for 64-bit alignment. Unix nano, the server
+	// won't be used before this time.
+	downUntil int64
+
+	addr     string
+	password string
+	timeout  time.Duration
+	fallback *Cache
+	entry    *logrus.Entry
+
+	idleConns chan *redisConn
+}
+
+// NewRedisCache returns a RedisCache. Each request to the server
+// will timeout after timeout. fallback can not be nil.
+func NewRedisCache(addr, password string, timeout time.Duration, fallback *Cache, entry *logrus.Entry) *RedisCache {
+	return &RedisCache{
+		addr:      addr,
+		password:  password,
+		timeout:   timeout,
+		fallback:  fallback,
+		entry:     entry,
+		idleConns: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+// Add adds r to the cache. r will expire after ttl.
+func (c *RedisCache) Add(key string, ttl time.Duration, r *dns.Msg) {
+	if ttl <= 0 {
+		return
+	}
+	if c.isDown() {
+		c.fallback.Add(key, ttl, r)
+		return
+	}
+
+	msg, err := r.Pack()
+	if err != nil {
+		return
+	}
+	v := make([]byte, 8+len(msg))
+	binary.BigEndian.PutUint64(v, uint64(time.Now().UnixNano()))
+	copy(v[8:], msg)
+
+	px := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if _, err := c.do("SET", []byte(redisKeyPrefix+key), v, []byte("PX"), []byte(px)); err != nil {
+		c.markDown(err)
+		c.fallback.Add(key, ttl, r)
+	}
+}
+
+// Get returns the cached response. The TTLs of its records are reduced
+// by the time it has spent in the cache. If key is not in the cache, Get returns nil.
+func (c *RedisCache) Get(key string) *dns.Msg {
+	if c.isDown() {
+		return c.fallback.Get(key)
+	}
+
+	reply, err := c.do("GET", []byte(redisKeyPrefix+key))
+	if err != nil {
+		if err == errRedisNil {
+			return nil
+		}
+		c.markDown(err)
+		return c.fallback.Get(key)
+	}
+
+	v, ok := reply.([]byte)
+	if !ok || len(v) < 8 {
+		return nil
+	}
+	storedTime := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	r := new(dns.Msg)
+	if err := r.Unpack(v[8:]); err != nil {
+		return nil
+	}
+	subtractTTL(r, uint32(time.Since(storedTime)/time.Second))
+	return r
+}
+
+func (c *RedisCache) isDown() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&c.downUntil)
+}
+
+func (c *RedisCache) markDown(err error) {
+	atomic.StoreInt64(&c.downUntil, time.Now().Add(redisRetryDelay).UnixNano())
+	c.entry.Warnf("redis cache: server %s is unreachable, use in-process cache for %s: %v", c.addr, redisRetryDelay, err)
+}
+
+func (c *RedisCache) do(args ...interface{}) (interface{}, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(c.timeout, args...)
+	if err != nil && err != errRedisNil {
+		conn.c.Close()
+		return nil, err
+	}
+	c.putConn(conn)
+	return reply, err
+}
+
+func (c *RedisCache) getConn() (*redisConn, error) {
+	select {
+	case conn := <-c.idleConns:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{c: nc, r: bufio.NewReader(nc)}
+	if len(c.password) != 0 {
+		if _, err := conn.do(c.timeout, "AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *RedisCache) putConn(conn *redisConn) {
+	select {
+	case c.idleConns <- conn:
+	default:
+		conn.c.Close()
+	}
+}
+
+type redisConn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply. args can be string or []byte.
+// The reply can be string, int64 or []byte. If the reply is a
+// nil bulk string, do returns errRedisNil.
+func (conn *redisConn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	conn.c.SetDeadline(time.Now().Add(timeout))
+
+	b := make([]byte, 0, 64)
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		var v []byte
+		switch arg := arg.(type) {
+		case string:
+			v = []byte(arg)
+		case []byte:
+			v = arg
+		default:
+			return nil, fmt.Errorf("redis: unsupported arg type %T", arg)
+		}
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(v)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, v...)
+		b = append(b, '\r', '\n')
+	}
+	if _, err := conn.c.Write(b); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(conn.r)
+}
+
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: invalid reply line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: server error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		v := make([]byte, n+2)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return nil, err
+		}
+		return v[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply type %q", line[0])
+	}
+}
@@ -0,0 +1,174 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// redisStandIn is a minimal in-process server that speaks the redis protocol.
+// It supports AUTH, GET and SET with PX.
+type redisStandIn struct {
+	l        net.Listener
+	password string
+
+	sync.Mutex
+	m map[string]redisValue
+}
+
+type redisValue struct {
+	v              []byte
+	expirationTime time.Time
+}
+
+func newRedisStandIn(password string) (*redisStandIn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &redisStandIn{l: l, password: password, m: make(map[string]redisValue)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s, nil
+}
+
+func (s *redisStandIn) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := len(s.password) == 0
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(string(args[0])); {
+		case cmd == "AUTH" && len(args) == 2:
+			if string(args[1]) == s.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-ERR invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SET" && len(args) == 5 && strings.ToUpper(string(args[3])) == "PX":
+			px, _ := strconv.Atoi(string(args[4]))
+			s.Lock()
+			s.m[string(args[1])] = redisValue{v: args[2], expirationTime: time.Now().Add(time.Millisecond * time.Duration(px))}
+			s.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "GET" && len(args) == 2:
+			s.Lock()
+			v, ok := s.m[string(args[1])]
+			s.Unlock()
+			if !ok || time.Now().After(v.expirationTime) {
+				reply = "$-1\r\n"
+			} else {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v.v), v.v)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readRedisCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '*' {
+		return nil, fmt.Errorf("invalid command")
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid command")
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := readRedisReply(r)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("invalid command")
+		}
+		args = append(args, b)
+	}
+	return args, nil
+}
+
+func Test_RedisCache(t *testing.T) {
+	s, err := newRedisStandIn("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := New(16)
+	c := NewRedisCache(s.l.Addr().String(), "pass", time.Second, fallback, logrus.NewEntry(logrus.StandardLogger()))
+	c.Add("a", time.Minute, newTestMsg("a.com", 60))
+	if fallback.Len() != 0 {
+		t.Fatal("response should be stored in redis")
+	}
+
+	// another instance that shares the same server
+	c2 := NewRedisCache(s.l.Addr().String(), "pass", time.Second, New(16), logrus.NewEntry(logrus.StandardLogger()))
+	if r := c2.Get("a"); r == nil || r.Answer[0].Header().Name != "a.com." {
+		t.Fatal("cached response not found")
+	}
+	if r := c2.Get("unknown"); r != nil {
+		t.Fatal("unknown key returned a response")
+	}
+	if c2.isDown() {
+		t.Fatal("nil reply should not mark the server down")
+	}
+
+	// server is unreachable, fallback to in-process cache
+	s.l.Close()
+	c3 := NewRedisCache(s.l.Addr().String(), "pass", time.Second, fallback, logrus.NewEntry(logrus.StandardLogger()))
+	c3.Add("b", time.Minute, newTestMsg("b.com", 60))
+	if !c3.isDown() {
+		t.Fatal("server should be marked down")
+	}
+	if r := c3.Get("b"); r == nil || r.Answer[0].Header().Name != "b.com." {
+		t.Fatal("response not found in fallback cache")
+	}
+}
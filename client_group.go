@@ -0,0 +1,287 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+)
+
+// clientGroup is a named group of clients that has its own routing policy.
+// Nil fields inherit the global settings.
+type clientGroup struct {
+	name string
+	ips  *ipv6.NetList
+	macs map[string]struct{}
+
+	rules                  []*rule // group rules, followed by global rules
+	localAllowedIPList     *ipList
+	localBlockedIPList     *ipList
+	localForcedDomainList  *domainList
+	localBlockedDomainList *domainList
+	localUpstream          *upstream
+	remoteUpstream         *upstream
+}
+
+// newClientGroup creates a group. globalRules are the user defined global
+// rules, they will be evaluated after the group rules.
+func newClientGroup(conf *ClientGroupConfig, upstreams map[string]*upstream, d *dispatcher, globalRules []*rule) (*clientGroup, error) {
+	if len(conf.Name) == 0 {
+		return nil, errors.New("missing name")
+	}
+	g := &clientGroup{name: conf.Name}
+
+	if len(conf.IP) != 0 {
+		g.ips = ipv6.NewNetList(make([]ipv6.Net, 0, len(conf.IP)))
+		for _, s := range conf.IP {
+			n, err := ipv6.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip [%s], %w", s, err)
+			}
+			g.ips.Append(n)
+		}
+		g.ips.Sort()
+	}
+
+	if len(conf.MAC) != 0 {
+		g.macs = make(map[string]struct{}, len(conf.MAC))
+		for _, s := range conf.MAC {
+			mac, err := net.ParseMAC(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mac [%s], %w", s, err)
+			}
+			g.macs[mac.String()] = struct{}{}
+		}
+	}
+
+	if len(conf.LocalUpstream) != 0 {
+		u, ok := upstreams[conf.LocalUpstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream [%s]", conf.LocalUpstream)
+		}
+		g.localUpstream = u
+	}
+	if len(conf.RemoteUpstream) != 0 {
+		u, ok := upstreams[conf.RemoteUpstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream [%s]", conf.RemoteUpstream)
+		}
+		g.remoteUpstream = u
+	}
+
+	if len(conf.LocalAllowedIPList) != 0 {
+		l, err := d.listWatcher.ipList(g.name+".local_allowed_ip_list", conf.LocalAllowedIPList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load allowed ip file, %w", err)
+		}
+		g.localAllowedIPList = l
+	}
+	if len(conf.LocalBlockedIPList) != 0 {
+		l, err := d.listWatcher.ipList(g.name+".local_blocked_ip_list", conf.LocalBlockedIPList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load blocked ip file, %w", err)
+		}
+		g.localBlockedIPList = l
+	}
+
+	for i, rc := range conf.Rules {
+		name := rc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("%s.rules[%d]", g.name, i)
+		}
+		r, err := newRule(name, rc, upstreams, d.listWatcher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule [%s], %w", name, err)
+		}
+		g.rules = append(g.rules, r)
+	}
+	g.rules = append(g.rules, globalRules...)
+
+	forced, blocked := d.localAllowedDomainList, d.localBlockedDomainList
+	if len(conf.LocalForcedDomainList) != 0 {
+		l, err := d.listWatcher.domainList(g.name+".local_forced_domain_list", conf.LocalForcedDomainList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load forced domain file, %w", err)
+		}
+		forced = l
+		g.localForcedDomainList = l
+	}
+	if len(conf.LocalBlockedDomainList) != 0 {
+		l, err := d.listWatcher.domainList(g.name+".local_blocked_domain_list", conf.LocalBlockedDomainList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load blocked domain file, %w", err)
+		}
+		blocked = l
+		g.localBlockedDomainList = l
+	}
+	g.rules = append(g.rules, d.builtinRules(forced, blocked)...)
+
+	return g, nil
+}
+
+// match reports whether the client belongs to g. leases can be nil.
+func (g *clientGroup) match(info *requestInfo, leases *dhcpLeases) bool {
+	if info == nil || info.clientIP == nil {
+		return false
+	}
+	if g.ips != nil {
+		if ip, err := ipv6.Conv(info.clientIP); err == nil && g.ips.Contains(ip) {
+			return true
+		}
+	}
+	if g.macs != nil && leases != nil {
+		if mac := leases.lookup(info.clientIP); len(mac) != 0 {
+			if _, ok := g.macs[mac]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// overridesRouting reports whether g routes queries differently from
+// the global settings. g can be nil.
+func (g *clientGroup) overridesRouting() bool {
+	return g != nil && (g.localUpstream != nil || g.remoteUpstream != nil || g.localAllowedIPList != nil || g.localBlockedIPList != nil)
+}
+
+// matchClientGroup returns the group of the client, or nil.
+func (d *dispatcher) matchClientGroup(info *requestInfo) *clientGroup {
+	for _, g := range d.clientGroups {
+		if g.match(info, d.dhcpLeases) {
+			return g
+		}
+	}
+	return nil
+}
+
+// builtinRules returns rules that implement forward_zones, qtype_routes, local_forced_domain_list,
+// local_blocked_domain_list and local_server_block_unusual_type.
+func (d *dispatcher) builtinRules(forced, blocked *domainList) []*rule {
+	rules := append([]*rule(nil), d.forwardZones...)
+	rules = append(rules, d.qtypeRoutes...)
+	if forced != nil {
+		rules = append(rules, &rule{name: "local_forced_domain_list", domains: forced, action: actionLocal})
+	}
+	if blocked != nil {
+		rules = append(rules, &rule{name: "local_blocked_domain_list", domains: blocked, action: actionRemote})
+	}
+	if d.localServerBlockUnusualType {
+		rules = append(rules, &rule{name: "local_server_block_unusual_type", unusualType: true, action: actionRemote})
+	}
+	return rules
+}
+
+const dhcpLeasesReloadInterval = time.Second * 10
+
+// dhcpLeases maps client IPs to MACs by reading a dnsmasq style
+// leases file. The file is reloaded if it was modified.
+type dhcpLeases struct {
+	lastChecked int64 // atomic, keep it first for 64-bit alignment. Unix nano.
+
+	file string
+
+	sync.RWMutex
+	m       map[string]string // ip -> mac
+	modTime time.Time
+}
+
+func newDHCPLeases(file string) (*dhcpLeases, error) {
+	l := &dhcpLeases{file: file, lastChecked: time.Now().UnixNano()}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the leases file. Each line of the file is
+// "<expiry> <mac> <ip> <hostname> <client-id>".
+func (l *dhcpLeases) load() error {
+	f, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			continue
+		}
+		m[ip.String()] = mac.String()
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.m = m
+	l.modTime = stat.ModTime()
+	l.Unlock()
+	return nil
+}
+
+// reloadIfModified reloads the file at most once per dhcpLeasesReloadInterval.
+// Only one caller checks the file, others return immediately.
+func (l *dhcpLeases) reloadIfModified() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.lastChecked)
+	if now-last < int64(dhcpLeasesReloadInterval) || !atomic.CompareAndSwapInt64(&l.lastChecked, last, now) {
+		return
+	}
+
+	l.RLock()
+	modTime := l.modTime
+	l.RUnlock()
+	stat, err := os.Stat(l.file)
+	if err != nil || stat.ModTime().Equal(modTime) {
+		return
+	}
+	l.load()
+}
+
+// lookup returns the MAC of ip, or an empty string.
+func (l *dhcpLeases) lookup(ip net.IP) string {
+	l.reloadIfModified()
+	l.RLock()
+	defer l.RUnlock()
+	return l.m[ip.String()]
+}
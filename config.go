@@ -32,12 +32,143 @@ type Config struct {
 	RemoteServerURL             string `json:"remote_server_url"`
 	RemoteServerSkipVerify      bool   `json:"remote_server_skip_verify"`
 	RemoteServerDelayStart      int    `json:"remote_server_delay_start"`
+	RemoteRequeryLocal          bool   `json:"remote_requery_local"`
 
-	LocalAllowedIPList     string `json:"local_allowed_ip_list"`
-	LocalBlockedIPList     string `json:"local_blocked_ip_list"`
-	LocalForcedDomainList  string `json:"local_forced_domain_list"`
-	LocalBlockedDomainList string `json:"local_blocked_domain_list"`
-	RemoteECSSubnet        string `json:"remote_ecs_subnet"`
+	LocalAllowedIPList     StringList `json:"local_allowed_ip_list"`
+	LocalBlockedIPList     StringList `json:"local_blocked_ip_list"`
+	LocalForcedDomainList  StringList `json:"local_forced_domain_list"`
+	LocalBlockedDomainList StringList `json:"local_blocked_domain_list"`
+	RemoteECSSubnet        string     `json:"remote_ecs_subnet"`
+
+	LocalDropBlockedCNAME bool `json:"local_drop_blocked_cname"`
+
+	ListCacheDir       string `json:"list_cache_dir"`
+	ListUpdateInterval int    `json:"list_update_interval"`
+	ListMinEntries     int    `json:"list_min_entries"`
+	ListBinaryDir      string `json:"list_binary_dir"`
+
+	CacheSize           int    `json:"cache_size"`
+	CacheDumpFile       string `json:"cache_dump_file"`
+	CacheDumpInterval   int    `json:"cache_dump_interval"`
+	CacheNegativeMaxTTL int    `json:"cache_negative_max_ttl"`
+	CacheRedisAddr      string `json:"cache_redis_addr"`
+	CacheRedisPassword  string `json:"cache_redis_password"`
+
+	RouteMemorySize            int    `json:"route_memory_size"`
+	RouteMemoryTTL             int    `json:"route_memory_ttl"`
+	RouteMemoryRecheckInterval int    `json:"route_memory_recheck_interval"`
+	RouteMemoryFile            string `json:"route_memory_file"`
+
+	StatusAddr string `json:"status_addr"`
+
+	Upstreams map[string]*UpstreamConfig `json:"upstreams"`
+	Rules     []*RuleConfig              `json:"rules"`
+
+	QtypeRoutes  map[string]string    `json:"qtype_routes"`
+	ForwardZones []*ForwardZoneConfig `json:"forward_zones"`
+
+	LocalRecords []string   `json:"local_records"`
+	HostsFiles   StringList `json:"hosts_files"`
+
+	Rewrites []*RewriteConfig `json:"rewrites"`
+
+	Blocklists []*BlocklistConfig `json:"blocklists"`
+	Allowlist  StringList         `json:"allowlist"`
+
+	ClientGroups   []*ClientGroupConfig `json:"client_groups"`
+	DHCPLeasesFile string               `json:"dhcp_leases_file"`
+
+	// compileLists is set by the -compile flag. Lists are loaded from
+	// their files and compiled into ListBinaryDir, nothing else is
+	// started.
+	compileLists bool
+}
+
+// UpstreamConfig is the config of a named upstream
+type UpstreamConfig struct {
+	Addr       string `json:"addr"`
+	Protocol   string `json:"protocol"`
+	URL        string `json:"url"`
+	ServerName string `json:"server_name"`
+	SkipVerify bool   `json:"skip_verify"`
+	Timeout    int    `json:"timeout"`
+}
+
+// RuleConfig is the config of a routing rule
+type RuleConfig struct {
+	Name string `json:"name"`
+
+	DomainList   string   `json:"domain_list"`
+	Qtype        []string `json:"qtype"`
+	ClientSubnet []string `json:"client_subnet"`
+	Listener     []string `json:"listener"`
+
+	Action   string   `json:"action"`
+	Upstream string   `json:"upstream"`
+	Rcode    string   `json:"rcode"`
+	Answer   []string `json:"answer"`
+}
+
+// ForwardZoneConfig forwards zones to an upstream. The upstream is either
+// a named upstream, or defined inline by the UpstreamConfig fields.
+type ForwardZoneConfig struct {
+	Zones    []string `json:"zones"`
+	Upstream string   `json:"upstream"`
+	UpstreamConfig
+}
+
+// RewriteConfig is the config of a rewrite rule. One of To and IP must be set.
+type RewriteConfig struct {
+	Name       string   `json:"name"`
+	Domain     []string `json:"domain"`
+	DomainList string   `json:"domain_list"`
+
+	To  string   `json:"to"`
+	IP  []string `json:"ip"`
+	TTL int      `json:"ttl"`
+}
+
+// BlocklistConfig is the config of a blocklist.
+type BlocklistConfig struct {
+	Name       string     `json:"name"`
+	List       StringList `json:"list"`
+	Response   string     `json:"response"`
+	SinkholeIP []string   `json:"sinkhole_ip"`
+	TTL        int        `json:"ttl"`
+}
+
+// ClientGroupConfig is the config of a client group. Empty fields
+// inherit the global settings.
+type ClientGroupConfig struct {
+	Name string   `json:"name"`
+	IP   []string `json:"ip"`
+	MAC  []string `json:"mac"`
+
+	LocalUpstream          string     `json:"local_upstream"`
+	RemoteUpstream         string     `json:"remote_upstream"`
+	LocalAllowedIPList     StringList `json:"local_allowed_ip_list"`
+	LocalBlockedIPList     StringList `json:"local_blocked_ip_list"`
+	LocalForcedDomainList  StringList `json:"local_forced_domain_list"`
+	LocalBlockedDomainList StringList `json:"local_blocked_domain_list"`
+
+	Rules []*RuleConfig `json:"rules"`
+}
+
+// StringList is a list of strings. In json, it can also be a single string.
+type StringList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if len(s) == 0 {
+			*l = nil
+		} else {
+			*l = StringList{s}
+		}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
 }
 
 func loadJSONConfig(configFile string) (*Config, error) {
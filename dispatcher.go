@@ -22,11 +22,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/IrineSistiana/mos-chinadns/cache"
 	"github.com/IrineSistiana/mos-chinadns/domainlist"
 
 	dohClient "github.com/IrineSistiana/mos-doh-client/client"
@@ -43,23 +45,57 @@ type dispatcher struct {
 	localServerBlockUnusualType bool
 	remoteServer                string
 	remoteServerDelayStart      time.Duration
+	remoteRequeryLocal          bool
 
 	localClient     *dns.Client
 	remoteClient    *dns.Client
 	remoteDoHClient *dohClient.DohClient
 
-	localAllowedIPList     *ipv6.NetList
-	localBlockedIPList     *ipv6.NetList
-	localAllowedDomainList *domainlist.List
-	localBlockedDomainList *domainlist.List
+	localAllowedIPList     *ipList
+	localBlockedIPList     *ipList
+	localAllowedDomainList *domainList
+	localBlockedDomainList *domainList
 	remoteECS              *dns.EDNS0_SUBNET
 
+	localDropBlockedCNAME bool
+
+	cache               responseCache
+	memCache            *cache.Cache // in-process cache, also the fallback of an external cache
+	cacheDumpFile       string
+	cacheNegativeMaxTTL time.Duration
+
+	inflight inflightGroup
+
+	routeMemory     *routeMemory
+	routeMemoryFile string
+
+	statusAddr string
+
+	localRecords *localRecords
+	rewrites     []*rewrite
+	blocklists   []*blocklist
+	allowlist    *domainList
+
+	rules        []*rule
+	qtypeRoutes  []*rule
+	forwardZones []*rule
+
+	clientGroups []*clientGroup
+	dhcpLeases   *dhcpLeases
+
+	listWatcher *listWatcher
+
 	entry *logrus.Entry
 }
 
 const (
 	queryTimeout    = time.Second * 3
 	dohQueryTimeout = time.Second * 3
+	redisTimeout    = time.Millisecond * 100
+
+	// how long the remote server waits for the local server
+	// if the domain was answered by the local server before.
+	routeMemoryLocalWait = time.Second
 )
 
 var (
@@ -98,6 +134,13 @@ func releaseTimer(timer *time.Timer) {
 func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 	d := new(dispatcher)
 	d.entry = entry
+	fetcher := newListFetcher(conf.ListCacheDir, time.Second*time.Duration(conf.ListUpdateInterval), conf.ListMinEntries, entry)
+	d.listWatcher = newListWatcher(entry, fetcher)
+	d.listWatcher.binDir = conf.ListBinaryDir
+	if len(d.listWatcher.binDir) == 0 {
+		d.listWatcher.binDir = defaultListBinaryDir
+	}
+	d.listWatcher.compile = conf.compileLists
 
 	if len(conf.BindAddr) == 0 {
 		return nil, errors.New("initDispather: missing args: bind address")
@@ -115,6 +158,8 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 		}
 	}
 	d.localServerBlockUnusualType = conf.LocalServerBlockUnusualType
+	d.remoteRequeryLocal = conf.RemoteRequeryLocal
+	d.localDropBlockedCNAME = conf.LocalDropBlockedCNAME
 	if len(conf.RemoteServer) != 0 {
 		d.remoteServer = conf.RemoteServer
 		if len(conf.RemoteServerURL) != 0 {
@@ -132,7 +177,7 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 	}
 
 	if len(conf.LocalAllowedIPList) != 0 {
-		allowedIPList, err := ipv6.NewNetListFromFile(conf.LocalAllowedIPList)
+		allowedIPList, err := d.listWatcher.ipList("local_allowed_ip_list", conf.LocalAllowedIPList)
 		if err != nil {
 			return nil, fmt.Errorf("initDispather: failed to load allowed ip file, %w", err)
 		}
@@ -141,7 +186,7 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 	}
 
 	if len(conf.LocalBlockedIPList) != 0 {
-		blockIPList, err := ipv6.NewNetListFromFile(conf.LocalBlockedIPList)
+		blockIPList, err := d.listWatcher.ipList("local_blocked_ip_list", conf.LocalBlockedIPList)
 		if err != nil {
 			return nil, fmt.Errorf("initDispather: failed to load blocked ip file, %w", err)
 		}
@@ -150,7 +195,7 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 	}
 
 	if len(conf.LocalForcedDomainList) != 0 {
-		dl, err := domainlist.LoadFormFile(conf.LocalForcedDomainList)
+		dl, err := d.listWatcher.domainList("local_forced_domain_list", conf.LocalForcedDomainList)
 		if err != nil {
 			return nil, fmt.Errorf("initDispather: failed to load forced domain file, %w", err)
 		}
@@ -159,7 +204,7 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 	}
 
 	if len(conf.LocalBlockedDomainList) != 0 {
-		dl, err := domainlist.LoadFormFile(conf.LocalBlockedDomainList)
+		dl, err := d.listWatcher.domainList("local_blocked_domain_list", conf.LocalBlockedDomainList)
 		if err != nil {
 			return nil, fmt.Errorf("initDispather: failed to load blocked domain file, %w", err)
 		}
@@ -207,16 +252,260 @@ func initDispather(conf *Config, entry *logrus.Entry) (*dispatcher, error) {
 		d.entry.Info("initDispather: ECS enabled")
 	}
 
+	// in compile mode, only lists are loaded. Caches, route memory, local
+	// records and dhcp leases are not used, and lists are not watched.
+	if conf.CacheSize > 0 && !conf.compileLists {
+		// with redis, the in-process cache is only a fallback, it's not
+		// worth dumping.
+		if len(conf.CacheRedisAddr) != 0 && len(conf.CacheDumpFile) != 0 {
+			return nil, errors.New("initDispather: cache_dump_file can not be used with cache_redis_addr")
+		}
+
+		d.memCache = cache.New(conf.CacheSize)
+		d.cache = d.memCache
+		d.entry.Infof("initDispather: cache enabled, size %d", conf.CacheSize)
+
+		if len(conf.CacheRedisAddr) != 0 {
+			d.cache = cache.NewRedisCache(conf.CacheRedisAddr, conf.CacheRedisPassword, redisTimeout, d.memCache, d.entry)
+			d.entry.Infof("initDispather: redis cache enabled, server %s", conf.CacheRedisAddr)
+		}
+
+		if conf.CacheNegativeMaxTTL > 0 {
+			d.cacheNegativeMaxTTL = time.Second * time.Duration(conf.CacheNegativeMaxTTL)
+			d.entry.Infof("initDispather: negative cache enabled, max ttl %ds", conf.CacheNegativeMaxTTL)
+		}
+
+		if len(conf.CacheDumpFile) != 0 {
+			d.cacheDumpFile = conf.CacheDumpFile
+			n, err := d.memCache.LoadFromFile(d.cacheDumpFile)
+			switch {
+			case err == nil:
+				d.entry.Infof("initDispather: %d cached responses loaded from %s", n, d.cacheDumpFile)
+			case os.IsNotExist(err):
+			case errors.Is(err, cache.ErrIncompatibleDump):
+				d.entry.Warnf("initDispather: ignored incompatible cache dump %s", d.cacheDumpFile)
+			default:
+				d.entry.Warnf("initDispather: failed to load cache dump %s, %v", d.cacheDumpFile, err)
+			}
+
+			if conf.CacheDumpInterval > 0 {
+				go d.dumpCacheLoop(time.Second * time.Duration(conf.CacheDumpInterval))
+			}
+		}
+	}
+
+	if conf.RouteMemorySize > 0 && !conf.compileLists {
+		ttl := defaultRouteMemoryTTL
+		if conf.RouteMemoryTTL > 0 {
+			ttl = time.Second * time.Duration(conf.RouteMemoryTTL)
+		}
+		recheckInterval := defaultRouteMemoryRecheckInterval
+		if conf.RouteMemoryRecheckInterval > 0 {
+			recheckInterval = time.Second * time.Duration(conf.RouteMemoryRecheckInterval)
+		}
+		d.routeMemory = newRouteMemory(conf.RouteMemorySize, ttl, recheckInterval)
+		d.entry.Infof("initDispather: route memory enabled, size %d, ttl %s, recheck interval %s", conf.RouteMemorySize, ttl, recheckInterval)
+
+		if len(conf.RouteMemoryFile) != 0 {
+			d.routeMemoryFile = conf.RouteMemoryFile
+			n, err := d.routeMemory.loadDomains(d.routeMemoryFile, pathRemote)
+			switch {
+			case err == nil:
+				d.entry.Infof("initDispather: %d domains loaded from route memory file %s", n, d.routeMemoryFile)
+			case os.IsNotExist(err):
+			default:
+				d.entry.Warnf("initDispather: failed to load route memory file %s, %v", d.routeMemoryFile, err)
+			}
+			go d.dumpRouteMemoryLoop(routeMemoryDumpInterval)
+		}
+	}
+
+	d.statusAddr = conf.StatusAddr
+
+	upstreams := make(map[string]*upstream, len(conf.Upstreams))
+	for name, uc := range conf.Upstreams {
+		u, err := newUpstream(name, uc)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid upstream [%s], %w", name, err)
+		}
+		upstreams[name] = u
+	}
+
+	for i, rc := range conf.Rules {
+		name := rc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		r, err := newRule(name, rc, upstreams, d.listWatcher)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid rule [%s], %w", name, err)
+		}
+		d.rules = append(d.rules, r)
+	}
+	if len(conf.Rules) != 0 {
+		d.entry.Infof("initDispather: %d rules loaded", len(conf.Rules))
+	}
+
+	if (len(conf.LocalRecords) != 0 || len(conf.HostsFiles) != 0) && !conf.compileLists {
+		lr, err := newLocalRecords(conf.LocalRecords, conf.HostsFiles, d.entry)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: %w", err)
+		}
+		d.localRecords = lr
+		if len(conf.HostsFiles) != 0 {
+			go lr.reloadLoop(hostsReloadInterval)
+		}
+	}
+
+	for i, rc := range conf.Rewrites {
+		name := rc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("rewrites[%d]", i)
+		}
+		rw, err := newRewrite(name, rc, d.listWatcher)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid rewrite [%s], %w", name, err)
+		}
+		d.rewrites = append(d.rewrites, rw)
+	}
+
+	for i, bc := range conf.Blocklists {
+		name := bc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("blocklists[%d]", i)
+		}
+		b, err := newBlocklist(name, bc, d.listWatcher)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid blocklist [%s], %w", name, err)
+		}
+		d.blocklists = append(d.blocklists, b)
+	}
+	if len(conf.Allowlist) != 0 {
+		l, err := d.listWatcher.domainList("allowlist", conf.Allowlist)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: failed to load allowlist, %w", err)
+		}
+		d.allowlist = l
+	}
+
+	for i, fc := range conf.ForwardZones {
+		name := fmt.Sprintf("forward_zones[%d]", i)
+		r, err := newForwardZone(name, fc, upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid %s, %w", name, err)
+		}
+		d.forwardZones = append(d.forwardZones, r)
+	}
+
+	qtypeRoutes, err := newQtypeRoutes(conf.QtypeRoutes)
+	if err != nil {
+		return nil, fmt.Errorf("initDispather: invalid qtype_routes, %w", err)
+	}
+	d.qtypeRoutes = qtypeRoutes
+
+	globalRules := d.rules
+	d.rules = append(d.rules, d.builtinRules(d.localAllowedDomainList, d.localBlockedDomainList)...)
+
+	if len(conf.DHCPLeasesFile) != 0 && !conf.compileLists {
+		leases, err := newDHCPLeases(conf.DHCPLeasesFile)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: failed to load dhcp leases file, %w", err)
+		}
+		d.dhcpLeases = leases
+	}
+	for i, gc := range conf.ClientGroups {
+		g, err := newClientGroup(gc, upstreams, d, globalRules)
+		if err != nil {
+			return nil, fmt.Errorf("initDispather: invalid client group [%d], %w", i, err)
+		}
+		if len(gc.MAC) != 0 && len(conf.DHCPLeasesFile) == 0 {
+			d.entry.Warnf("initDispather: client group [%s] has MACs but dhcp_leases_file is not set", g.name)
+		}
+		d.clientGroups = append(d.clientGroups, g)
+	}
+
+	// give every rule an unique id, rules are shared between groups.
+	id := 0
+	numbered := make(map[*rule]struct{})
+	numberRules := func(rules []*rule) {
+		for _, r := range rules {
+			if _, ok := numbered[r]; !ok {
+				numbered[r] = struct{}{}
+				r.id = id
+				id++
+			}
+		}
+	}
+	numberRules(d.rules)
+	for _, g := range d.clientGroups {
+		numberRules(g.rules)
+	}
+
+	if !conf.compileLists {
+		go d.listWatcher.run()
+	}
+
 	return d, nil
 }
 
+// dumpRouteMemory writes domains that were answered by the remote server
+// to the route memory file, if any.
+func (d *dispatcher) dumpRouteMemory() {
+	if d.routeMemory == nil || len(d.routeMemoryFile) == 0 {
+		return
+	}
+	n, err := d.routeMemory.dumpDomains(d.routeMemoryFile, pathRemote)
+	if err != nil {
+		d.entry.Warnf("dumpRouteMemory: failed to dump route memory to %s, %v", d.routeMemoryFile, err)
+		return
+	}
+	d.entry.Debugf("dumpRouteMemory: %d domains dumped to %s", n, d.routeMemoryFile)
+}
+
+func (d *dispatcher) dumpRouteMemoryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.dumpRouteMemory()
+	}
+}
+
+// dumpCache writes the cache to the dump file, if any.
+func (d *dispatcher) dumpCache() {
+	if d.memCache == nil || len(d.cacheDumpFile) == 0 {
+		return
+	}
+	n, err := d.memCache.DumpToFile(d.cacheDumpFile)
+	if err != nil {
+		d.entry.Warnf("dumpCache: failed to dump cache to %s, %v", d.cacheDumpFile, err)
+		return
+	}
+	d.entry.Debugf("dumpCache: %d responses dumped to %s", n, d.cacheDumpFile)
+}
+
+func (d *dispatcher) dumpCacheLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.dumpCache()
+	}
+}
+
 func (d *dispatcher) ListenAndServe() error {
 	return dns.ListenAndServe(d.bindAddr, "udp", d)
 }
 
 // ServeDNS impliment the interface
 func (d *dispatcher) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
-	r := d.serveDNS(q)
+	info := &requestInfo{listener: w.LocalAddr().String()}
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		info.clientIP = addr.IP
+	case *net.TCPAddr:
+		info.clientIP = addr.IP
+	}
+
+	r := d.serveDNS(q, info)
 	if r != nil {
 		w.WriteMsg(r)
 	}
@@ -226,8 +515,17 @@ func isUnusualType(q *dns.Msg) bool {
 	return q.Opcode != dns.OpcodeQuery || len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || (q.Question[0].Qtype != dns.TypeA && q.Question[0].Qtype != dns.TypeAAAA)
 }
 
+// cacheKey returns the cache key of q. If q can not be cached, cacheKey returns an empty string.
+func cacheKey(q *dns.Msg) string {
+	if q.Opcode != dns.OpcodeQuery || len(q.Question) != 1 {
+		return ""
+	}
+	question := q.Question[0]
+	return strings.ToLower(question.Name) + " " + strconv.Itoa(int(question.Qtype)) + " " + strconv.Itoa(int(question.Qclass))
+}
+
 // check if q has a blocked QName. If q and reList is nil, return false.
-func inDomainList(q *dns.Msg, l *domainlist.List) bool {
+func inDomainList(q *dns.Msg, l *domainList) bool {
 	if l == nil || q == nil {
 		return false
 	}
@@ -239,63 +537,169 @@ func inDomainList(q *dns.Msg, l *domainlist.List) bool {
 	return false
 }
 
-func (d *dispatcher) hasRemote() bool {
-	return d.remoteClient != nil || d.remoteDoHClient != nil
+// matchDomainList returns the entry of l that q matches, or nil.
+func matchDomainList(q *dns.Msg, l *domainList) *domainlist.Match {
+	for i := range q.Question {
+		if m := l.Match(q.Question[i].Name); m != nil && !m.Exception {
+			return m
+		}
+	}
+	return nil
+}
+
+// g can be nil.
+func (d *dispatcher) hasRemote(g *clientGroup) bool {
+	return (g != nil && g.remoteUpstream != nil) || d.remoteClient != nil || d.remoteDoHClient != nil
 }
 
-func (d *dispatcher) hasLocal() bool {
-	return d.localClient != nil
+// g can be nil.
+func (d *dispatcher) hasLocal(g *clientGroup) bool {
+	return (g != nil && g.localUpstream != nil) || d.localClient != nil
 }
 
-// serveDNS: r might be nil
-func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
+// serveDNS: r might be nil. info can be nil.
+func (d *dispatcher) serveDNS(q *dns.Msg, info *requestInfo) *dns.Msg {
 	requestLogger := d.entry.WithFields(logrus.Fields{
 		"id":       q.Id,
 		"question": q.Question,
 	})
 
-	localOnly := inDomainList(q, d.localAllowedDomainList)
-	if localOnly {
-		requestLogger.Debug("serveDNS: is forced domain")
+	if rw := d.matchRewrite(q); rw != nil {
+		requestLogger = requestLogger.WithField("rewrite", rw.name)
+		return d.rewrite(q, info, rw, requestLogger)
 	}
-	localBlocked := inDomainList(q, d.localBlockedDomainList)
-	if localBlocked {
-		requestLogger.Debug("serveDNS: is blocked domain")
+	if b := d.matchBlocklist(q); b != nil {
+		requestLogger = requestLogger.WithField("blocklist", b.name)
+		if requestLogger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			requestLogger = requestLogger.WithField("entry", b.domains.Match(q.Question[0].Name))
+		}
+		requestLogger.Debug("serveDNS: blocked")
+		return b.reply(q)
 	}
+	return d.resolve(q, info, requestLogger)
+}
 
-	var doLocal, doRemote bool
-	if d.hasLocal() {
-		switch {
-		case localOnly:
-			doLocal = true
-		case localBlocked:
-			doLocal = false
-		case isUnusualType(q):
-			doLocal = !d.localServerBlockUnusualType
-		default:
-			doLocal = true
+// resolve answers q by local records, rules, cache and servers. r might be nil. info can be nil.
+func (d *dispatcher) resolve(q *dns.Msg, info *requestInfo, requestLogger *logrus.Entry) *dns.Msg {
+	if d.localRecords != nil {
+		if r := d.localRecords.reply(q); r != nil {
+			requestLogger.Debug("serveDNS: answered by local records")
+			return r
 		}
-	} else {
-		doLocal = false
 	}
 
-	if d.hasRemote() {
-		switch {
-		case localOnly:
-			doRemote = false
-		case localBlocked:
-			doRemote = true
-		default:
-			doRemote = true
+	g := d.matchClientGroup(info)
+	var ruleKey string
+	if g != nil {
+		requestLogger = requestLogger.WithField("group", g.name)
+		ruleKey = " group " + g.name
+	}
+
+	action := actionRace
+	if matched := d.matchRule(q, info, g); matched != nil {
+		requestLogger = requestLogger.WithField("rule", matched.name)
+		if matched.domains != nil && requestLogger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			requestLogger.WithField("entry", matchDomainList(q, matched.domains)).Debug("serveDNS: matched rule")
+		} else {
+			requestLogger.Debug("serveDNS: matched rule")
+		}
+		switch matched.action {
+		case actionBlock, actionStatic:
+			return matched.reply(q)
+		case actionUpstream:
+			return d.queryUpstream(q, matched.upstream, requestLogger)
+		}
+		action = matched.action
+		ruleKey += " rule " + strconv.Itoa(matched.id)
+	}
+
+	var key string
+	if d.cache != nil {
+		key = cacheKey(q)
+		if len(key) != 0 {
+			key += ruleKey
+			if r := d.cache.Get(key); r != nil {
+				requestLogger.Debug("serveDNS: cache hit")
+				r.Id = q.Id
+				r.Question = q.Question
+				return r
+			}
+		}
+	}
+
+	var r *dns.Msg
+	if inflight := inflightKey(q); len(inflight) != 0 {
+		var shared bool
+		r, shared = d.inflight.do(inflight+ruleKey, func() *dns.Msg { return d.dispatch(q, action, g, requestLogger) })
+		if shared && r != nil {
+			requestLogger.Debug("serveDNS: shared result of an identical query")
+			r = r.Copy()
+			r.Id = q.Id
+			r.Question = q.Question
 		}
 	} else {
-		doRemote = false
+		r = d.dispatch(q, action, g, requestLogger)
+	}
+
+	if len(key) != 0 && r != nil && r.Rcode == dns.RcodeSuccess && len(r.Answer) != 0 {
+		d.cache.Add(key, time.Second*time.Duration(cache.MinTTL(r)), r)
+	}
+	return r
+}
+
+// queryUpstream sends q to the upstream u. r might be nil.
+func (d *dispatcher) queryUpstream(q *dns.Msg, u *upstream, requestLogger *logrus.Entry) *dns.Msg {
+	requestLogger.Debugf("serveDNS: query upstream %s", u.name)
+	r, rtt, err := u.exchange(context.Background(), q)
+	if err != nil {
+		requestLogger.Warnf("serveDNS: upstream %s failed: %v", u.name, err)
+		r = new(dns.Msg)
+		r.SetRcode(q, dns.RcodeServerFailure)
+		return r
+	}
+	requestLogger.Debugf("serveDNS: get reply from upstream %s, rtt: %dms", u.name, rtt.Milliseconds())
+	return r
+}
+
+// responseCache is a dns response cache.
+type responseCache interface {
+	Add(key string, ttl time.Duration, r *dns.Msg)
+	Get(key string) *dns.Msg
+}
+
+type dispatchResult struct {
+	r    *dns.Msg
+	path string
+}
+
+// dispatch sends q to local and/or remote server depending on action,
+// and returns the first acceptable result. r might be nil. g can be nil.
+func (d *dispatcher) dispatch(q *dns.Msg, action ruleAction, g *clientGroup, requestLogger *logrus.Entry) *dns.Msg {
+	// route memory is shared, groups with their own routing don't use it.
+	useRouteMemory := d.routeMemory != nil && action == actionRace && !isUnusualType(q) && !g.overridesRouting()
+	var remembered string
+	if useRouteMemory {
+		remembered = d.routeMemory.lookup(q.Question[0].Name)
+		if len(remembered) != 0 {
+			requestLogger.Debugf("serveDNS: route memory: answered by %s", remembered)
+		}
+	}
+
+	var doLocal, doRemote bool
+	switch {
+	case action == actionLocal:
+		doLocal = d.hasLocal(g)
+	case action == actionRemote, remembered == pathRemote:
+		doRemote = d.hasRemote(g)
+	default:
+		doLocal = d.hasLocal(g)
+		doRemote = d.hasRemote(g)
 	}
 
 	ctx, cancelQuery := context.WithTimeout(context.Background(), queryTimeout)
 	defer cancelQuery()
 
-	resChan := make(chan *dns.Msg, 1)
+	resChan := make(chan *dispatchResult, 1)
 	wgChan := make(chan struct{}, 0)
 	wg := sync.WaitGroup{}
 	var localServerDone chan struct{}
@@ -309,7 +713,7 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 		go func() {
 			defer wg.Done()
 			requestLogger.Debug("serveDNS: query local server")
-			res, rtt, err := d.queryLocal(ctx, q)
+			res, rtt, err := d.queryLocal(ctx, q, g)
 			if err != nil {
 				requestLogger.Warnf("serveDNS: local server failed: %v", err)
 				close(localServerFailed)
@@ -317,14 +721,14 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 			}
 
 			requestLogger.Debugf("serveDNS: get reply from local, rtt: %dms", rtt.Milliseconds())
-			if !localOnly && d.dropLoaclRes(res, requestLogger) {
+			if action != actionLocal && d.dropLoaclRes(res, g, requestLogger) {
 				requestLogger.Debug("serveDNS: local result droped")
 				close(localServerFailed)
 				return
 			}
 
 			select {
-			case resChan <- res:
+			case resChan <- &dispatchResult{r: res, path: pathLocal}:
 			default:
 			}
 			close(localServerDone)
@@ -338,8 +742,16 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 		go func() {
 			defer wg.Done()
 
-			if doLocal && d.remoteServerDelayStart > 0 {
-				timer := getTimer(d.remoteServerDelayStart)
+			var delay time.Duration
+			if doLocal {
+				delay = d.remoteServerDelayStart
+				if remembered == pathLocal && delay < routeMemoryLocalWait {
+					delay = routeMemoryLocalWait
+				}
+			}
+
+			if delay > 0 {
+				timer := getTimer(delay)
 				defer releaseTimer(timer)
 				select {
 				case <-localServerDone:
@@ -350,15 +762,41 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 			}
 
 			requestLogger.Debug("serveDNS: query remote server")
-			res, rtt, err := d.queryRemote(ctx, q)
+			res, rtt, err := d.queryRemote(ctx, q, g)
 			if err != nil {
 				requestLogger.Warnf("serveDNS: remote server failed: %v", err)
 				return
 			}
 			requestLogger.Debugf("serveDNS: get reply from remote, rtt: %dms", rtt.Milliseconds())
 
+			// the remote server picked a node in the allowed ip list (a China CDN node
+			// for example), the local server may know a better one.
+			if d.remoteRequeryLocal && action == actionRace && d.answerAllowed(res, g, requestLogger) {
+				if doLocal {
+					requestLogger.Debug("serveDNS: remote result IP is allowed, waiting for local")
+					select {
+					case <-localServerDone:
+						return
+					case <-localServerFailed:
+					case <-ctx.Done():
+						return
+					}
+				} else if d.hasLocal(g) {
+					requestLogger.Debug("serveDNS: remote result IP is allowed, re-query local server")
+					lr, rtt, err := d.queryLocal(ctx, q, g)
+					if err == nil && !d.dropLoaclRes(lr, g, requestLogger) {
+						requestLogger.Debugf("serveDNS: local result accepted, rtt: %dms", rtt.Milliseconds())
+						select {
+						case resChan <- &dispatchResult{r: lr, path: pathLocal}:
+						default:
+						}
+						return
+					}
+				}
+			}
+
 			select {
-			case resChan <- res:
+			case resChan <- &dispatchResult{r: res, path: pathRemote}:
 			default:
 			}
 		}()
@@ -371,8 +809,11 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 	}()
 
 	select {
-	case r := <-resChan:
-		return r
+	case res := <-resChan:
+		if useRouteMemory && doLocal && doRemote {
+			d.routeMemory.learn(q.Question[0].Name, res.path)
+		}
+		return res.r
 	case <-wgChan:
 		r := new(dns.Msg)
 		r.SetReply(q)
@@ -384,23 +825,117 @@ func (d *dispatcher) serveDNS(q *dns.Msg) *dns.Msg {
 	}
 }
 
-func (d *dispatcher) queryLocal(ctx context.Context, q *dns.Msg) (*dns.Msg, time.Duration, error) {
-	return d.localClient.ExchangeContext(ctx, q, d.localServer)
+// upstream paths, negative responses are cached separately per path.
+const (
+	pathLocal  = "local"
+	pathRemote = "remote"
+)
+
+// getNegativeCache returns the cached negative response of q from path, or nil.
+func (d *dispatcher) getNegativeCache(path string, q *dns.Msg) *dns.Msg {
+	if d.cacheNegativeMaxTTL <= 0 {
+		return nil
+	}
+	key := cacheKey(q)
+	if len(key) == 0 {
+		return nil
+	}
+	r := d.cache.Get(path + " " + key)
+	if r != nil {
+		r.Id = q.Id
+		r.Question = q.Question
+	}
+	return r
+}
+
+// tryAddNegativeCache caches r if it is a negative response as defined in RFC 2308.
+func (d *dispatcher) tryAddNegativeCache(path string, q, r *dns.Msg) {
+	if d.cacheNegativeMaxTTL <= 0 {
+		return
+	}
+	key := cacheKey(q)
+	if len(key) == 0 {
+		return
+	}
+	negativeTTL, ok := cache.NegativeTTL(r)
+	if !ok {
+		return
+	}
+	ttl := time.Second * time.Duration(negativeTTL)
+	if ttl > d.cacheNegativeMaxTTL {
+		ttl = d.cacheNegativeMaxTTL
+	}
+
+	// RFC 2308 section 5: the TTL of the SOA record is the negative ttl.
+	r = r.Copy()
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			rr.Header().Ttl = uint32(ttl / time.Second)
+		}
+	}
+	d.cache.Add(path+" "+key, ttl, r)
+}
+
+// queryLocal: g can be nil.
+func (d *dispatcher) queryLocal(ctx context.Context, q *dns.Msg, g *clientGroup) (*dns.Msg, time.Duration, error) {
+	if g != nil && g.localUpstream != nil {
+		return d.queryGroupUpstream(ctx, q, g.localUpstream)
+	}
+
+	if r := d.getNegativeCache(pathLocal, q); r != nil {
+		return r, 0, nil
+	}
+
+	r, rtt, err := d.localClient.ExchangeContext(ctx, q, d.localServer)
+	if err == nil {
+		d.tryAddNegativeCache(pathLocal, q, r)
+	}
+	return r, rtt, err
 }
 
 //queryRemote WARNING: to save memory we may modify q directly.
-func (d *dispatcher) queryRemote(ctx context.Context, q *dns.Msg) (*dns.Msg, time.Duration, error) {
+func (d *dispatcher) queryRemote(ctx context.Context, q *dns.Msg, g *clientGroup) (*dns.Msg, time.Duration, error) {
 	if d.remoteECS != nil {
 		appendECSIfNotExist(q, d.remoteECS)
 	}
 
+	if g != nil && g.remoteUpstream != nil {
+		return d.queryGroupUpstream(ctx, q, g.remoteUpstream)
+	}
+
+	if r := d.getNegativeCache(pathRemote, q); r != nil {
+		return r, 0, nil
+	}
+
+	var r *dns.Msg
+	var rtt time.Duration
+	var err error
 	if d.remoteDoHClient != nil {
 		t := time.Now()
-		r, err := d.remoteDoHClient.Exchange(q)
-		return r, time.Since(t), err
+		r, err = d.remoteDoHClient.Exchange(q)
+		rtt = time.Since(t)
+	} else {
+		r, rtt, err = d.remoteClient.ExchangeContext(ctx, q, d.remoteServer)
+	}
+	if err == nil {
+		d.tryAddNegativeCache(pathRemote, q, r)
+	}
+	return r, rtt, err
+}
+
+// queryGroupUpstream sends q to u, which replaces the local or remote
+// server of a client group.
+func (d *dispatcher) queryGroupUpstream(ctx context.Context, q *dns.Msg, u *upstream) (*dns.Msg, time.Duration, error) {
+	path := "upstream " + u.name
+	if r := d.getNegativeCache(path, q); r != nil {
+		return r, 0, nil
 	}
 
-	return d.remoteClient.ExchangeContext(ctx, q, d.remoteServer)
+	r, rtt, err := u.exchange(ctx, q)
+	if err == nil {
+		d.tryAddNegativeCache(path, q, r)
+	}
+	return r, rtt, err
 }
 
 // both q and ecs shouldn't be nil
@@ -428,8 +963,8 @@ func appendECSIfNotExist(q *dns.Msg, ecs *dns.EDNS0_SUBNET) {
 	}
 }
 
-// check if local result should be droped, res can be nil.
-func (d *dispatcher) dropLoaclRes(res *dns.Msg, requestLogger *logrus.Entry) bool {
+// check if local result should be droped, res and g can be nil.
+func (d *dispatcher) dropLoaclRes(res *dns.Msg, g *clientGroup, requestLogger *logrus.Entry) bool {
 	if res == nil {
 		requestLogger.Debug("dropLoaclRes: result is nil")
 		return true
@@ -445,18 +980,37 @@ func (d *dispatcher) dropLoaclRes(res *dns.Msg, requestLogger *logrus.Entry) boo
 		return true
 	}
 
+	forced, blocked := d.localAllowedDomainList, d.localBlockedDomainList
+	if g != nil {
+		if g.localForcedDomainList != nil {
+			forced = g.localForcedDomainList
+		}
+		if g.localBlockedDomainList != nil {
+			blocked = g.localBlockedDomainList
+		}
+	}
+	if d.localDropBlockedCNAME && cnameInDomainList(res.Answer, blocked) {
+		requestLogger.Debug("dropLoaclRes: result has a CNAME to a blocked domain")
+		return true
+	}
+	if cnameInDomainList(res.Answer, forced) {
+		requestLogger.Debug("dropLoaclRes: result has a CNAME to a forced domain")
+		return false
+	}
+
 	if isUnusualType(res) && !d.localServerBlockUnusualType {
 		requestLogger.Debug("dropLoaclRes: result is an unusual type")
 		return false
 	}
 
-	if d.localBlockedIPList != nil && anwsersMatchNetList(res.Answer, d.localBlockedIPList, requestLogger) {
+	blockedIPList, allowedIPList := d.localIPLists(g)
+	if blockedIPList != nil && anwsersMatchNetList(res.Answer, blockedIPList, requestLogger) {
 		requestLogger.Debug("dropLoaclRes: result IP is blocked")
 		return true
 	}
 
-	if d.localAllowedIPList != nil {
-		if anwsersMatchNetList(res.Answer, d.localAllowedIPList, requestLogger) {
+	if allowedIPList != nil {
+		if anwsersMatchNetList(res.Answer, allowedIPList, requestLogger) {
 			requestLogger.Debug("dropLoaclRes: result IP is allowed")
 			return false
 		}
@@ -468,8 +1022,41 @@ func (d *dispatcher) dropLoaclRes(res *dns.Msg, requestLogger *logrus.Entry) boo
 	return false
 }
 
+// localIPLists returns the ip lists that judge local results of g. g can be nil.
+func (d *dispatcher) localIPLists(g *clientGroup) (blocked, allowed *ipList) {
+	blocked, allowed = d.localBlockedIPList, d.localAllowedIPList
+	if g != nil {
+		if g.localBlockedIPList != nil {
+			blocked = g.localBlockedIPList
+		}
+		if g.localAllowedIPList != nil {
+			allowed = g.localAllowedIPList
+		}
+	}
+	return blocked, allowed
+}
+
+// answerAllowed reports whether res has an IP in the allowed ip list. res and g can be nil.
+func (d *dispatcher) answerAllowed(res *dns.Msg, g *clientGroup, requestLogger *logrus.Entry) bool {
+	_, allowed := d.localIPLists(g)
+	return res != nil && allowed != nil && anwsersMatchNetList(res.Answer, allowed, requestLogger)
+}
+
+// cnameInDomainList reports whether a CNAME target in anwser is in l. l can be nil.
+func cnameInDomainList(anwser []dns.RR, l *domainList) bool {
+	if l == nil {
+		return false
+	}
+	for i := range anwser {
+		if cname, ok := anwser[i].(*dns.CNAME); ok && l.Has(cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
 // list can not be nil
-func anwsersMatchNetList(anwser []dns.RR, list *ipv6.NetList, requestLogger *logrus.Entry) bool {
+func anwsersMatchNetList(anwser []dns.RR, list *ipList, requestLogger *logrus.Entry) bool {
 	var matched bool
 	for i := range anwser {
 		var ip ipv6.IPv6
@@ -19,12 +19,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
 	"github.com/IrineSistiana/mosdns/core/ipv6"
 	"github.com/miekg/dns"
 )
@@ -32,9 +38,11 @@ import (
 type vServer struct {
 	latency time.Duration
 	ip      net.IP
+	count   uint32
 }
 
 func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	atomic.AddUint32(&s.count, 1)
 
 	name := q.Question[0].Name
 
@@ -88,13 +96,13 @@ func initTestDispatherAndServer(lLatency, rLatency time.Duration, lIP, rIP net.I
 	if err != nil {
 		return nil, nil, err
 	}
-	d.localAllowedIPList = allowedIP
+	d.localAllowedIPList = newIPList(allowedIP)
 
 	blockedIP, err := ipv6.NewNetListFromReader(bytes.NewReader([]byte(block)))
 	if err != nil {
 		return nil, nil, err
 	}
-	d.localBlockedIPList = blockedIP
+	d.localBlockedIPList = newIPList(blockedIP)
 
 	return d, func() {
 		ls.Shutdown()
@@ -117,7 +125,7 @@ func Test_dispatcher_ServeDNS_FastServer(t *testing.T) {
 
 		q := new(dns.Msg)
 		q.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
-		r := d.serveDNS(q)
+		r := d.serveDNS(q, nil)
 		if r == nil || r.Rcode != dns.RcodeSuccess {
 			t.Fatal("invalied r")
 		}
@@ -153,7 +161,7 @@ func Test_dispatcher_ServeDNS_AllowedIP(t *testing.T) {
 
 		q := new(dns.Msg)
 		q.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
-		r := d.serveDNS(q)
+		r := d.serveDNS(q, nil)
 		if r == nil || r.Rcode != dns.RcodeSuccess {
 			t.Fatal("invalied r")
 		}
@@ -189,7 +197,7 @@ func Test_dispatcher_ServeDNS_BlockedIP(t *testing.T) {
 
 		q := new(dns.Msg)
 		q.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
-		r := d.serveDNS(q)
+		r := d.serveDNS(q, nil)
 		if r == nil || r.Rcode != dns.RcodeSuccess {
 			t.Fatal("invalied r")
 		}
@@ -205,3 +213,698 @@ func Test_dispatcher_ServeDNS_BlockedIP(t *testing.T) {
 	//允许的IP, 接受
 	test(0, time.Millisecond*500, lIPAllowed, lIPAllowed)
 }
+
+type nxServer struct {
+	count uint32
+}
+
+func (s *nxServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	atomic.AddUint32(&s.count, 1)
+
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeNameError)
+	r.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 300,
+	}}
+	w.WriteMsg(r)
+}
+
+func Test_dispatcher_ServeDNS_NegativeCache(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	c := Config{BindAddr: "127.0.0.1:0", CacheSize: 16, CacheNegativeMaxTTL: 60}
+	var servers [2]*nxServer
+	for i, addr := range []*string{&c.LocalServer, &c.RemoteServer} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = new(nxServer)
+		s := dns.Server{PacketConn: conn, Handler: servers[i]}
+		go s.ActivateAndServe()
+		defer s.Shutdown()
+		*addr = conn.LocalAddr().String()
+	}
+
+	d, err := initDispather(&c, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("nx.example.com.", dns.TypeA)
+		r := d.serveDNS(q, nil)
+		if r == nil || r.Rcode != dns.RcodeNameError || r.Id != q.Id {
+			t.Fatal("invalid r")
+		}
+	}
+
+	for i, s := range servers {
+		if n := atomic.LoadUint32(&s.count); n != 1 {
+			t.Fatalf("server %d: want 1 query, got %d", i, n)
+		}
+	}
+
+	if ttl := d.cache.Get(pathRemote + " " + cacheKey(new(dns.Msg).SetQuestion("nx.example.com.", dns.TypeA))).Ns[0].Header().Ttl; ttl != 60 {
+		t.Fatalf("want ttl 60, got %d", ttl)
+	}
+}
+
+func Test_dispatcher_ServeDNS_Inflight(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &vServer{ip: net.IPv4(1, 1, 1, 1), latency: time.Millisecond * 200}
+	s := dns.Server{PacketConn: conn, Handler: remote}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	c := Config{BindAddr: "127.0.0.1:0", RemoteServer: conn.LocalAddr().String()}
+	d, err := initDispather(&c, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			q.Id = uint16(i)
+			r := d.serveDNS(q, nil)
+			if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+				t.Error("invalid r")
+				return
+			}
+			if r.Id != q.Id {
+				t.Errorf("want id %d, got %d", q.Id, r.Id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadUint32(&remote.count); n != 1 {
+		t.Fatalf("want 1 upstream query, got %d", n)
+	}
+}
+
+func Test_initDispather_CacheDumpWithRedis(t *testing.T) {
+	c := Config{
+		BindAddr:       "127.0.0.1:0",
+		RemoteServer:   "127.0.0.1:53",
+		CacheSize:      16,
+		CacheDumpFile:  "cache.dump",
+		CacheRedisAddr: "127.0.0.1:6379",
+	}
+	if _, err := initDispather(&c, logrus.NewEntry(logrus.StandardLogger())); err == nil {
+		t.Fatal("cache_dump_file with cache_redis_addr should be rejected")
+	}
+}
+
+func Test_inflightGroup_do_panic(t *testing.T) {
+	g := new(inflightGroup)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.do("key", func() *dns.Msg {
+			close(started)
+			<-release
+			panic("test")
+		})
+	}()
+	<-started
+
+	done := make(chan *dns.Msg)
+	go func() {
+		r, _ := g.do("key", func() *dns.Msg { return new(dns.Msg) })
+		done <- r
+	}()
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after fn panicked")
+	}
+
+	if r, _ := g.do("key", func() *dns.Msg { return new(dns.Msg) }); r == nil {
+		t.Fatal("key was not released after fn panicked")
+	}
+}
+
+func Test_dispatcher_ServeDNS_RouteMemory(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIPBlocked := net.IPv4(128, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIPBlocked, rIP, "0.0.0.0/1", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+	d.routeMemory = newRouteMemory(16, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("Example.com.", dns.TypeA)
+		r := d.serveDNS(q, nil)
+		if r == nil || r.Rcode != dns.RcodeSuccess || !r.Answer[0].(*dns.A).A.Equal(rIP) {
+			t.Fatal("invalid r")
+		}
+		if path := d.routeMemory.lookup("example.com."); path != pathRemote {
+			t.Fatalf("want path %s, got %s", pathRemote, path)
+		}
+	}
+
+	// recheck
+	d.routeMemory.m["example.com."].learnedTime = time.Now().Add(-time.Hour)
+	if path := d.routeMemory.lookup("example.com."); path != "" {
+		t.Fatalf("entry should be rechecked, got %s", path)
+	}
+
+	// ttl
+	d.routeMemory.m["example.com."].usedTime = time.Now().Add(-time.Hour)
+	if path := d.routeMemory.lookup("example.com."); path != "" || d.routeMemory.len() != 0 {
+		t.Fatal("expired entry should be removed")
+	}
+}
+
+func Test_dispatcher_ServeDNS_Rules(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIP, rIP, "0.0.0.0/0", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	for i, rc := range []*RuleConfig{
+		{Qtype: []string{"txt"}, ClientSubnet: []string{"10.0.0.0/8"}, Action: "block", Rcode: "REFUSED"},
+		{Qtype: []string{"AAAA"}, Action: "static", Answer: []string{"60 IN AAAA ::1", "60 IN A 1.2.3.4"}},
+		{Listener: []string{"127.0.0.1:53"}, Action: "remote"},
+	} {
+		r, err := newRule(rc.Name, rc, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.id = i
+		d.rules = append(d.rules, r)
+	}
+
+	query := func(qtype uint16, info *requestInfo) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		r := d.serveDNS(q, info)
+		if r == nil {
+			t.Fatal("nil r")
+		}
+		return r
+	}
+
+	// blocked
+	if r := query(dns.TypeTXT, &requestInfo{clientIP: net.IPv4(10, 1, 1, 1)}); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want REFUSED, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	// static
+	r := query(dns.TypeAAAA, nil)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatal("invalid static answer")
+	}
+	if aaaa := r.Answer[0].(*dns.AAAA); aaaa.Hdr.Name != "example.com." || !aaaa.AAAA.Equal(net.IPv6loopback) {
+		t.Fatal("invalid static answer")
+	}
+
+	// remote only
+	if r := query(dns.TypeA, &requestInfo{listener: "127.0.0.1:53"}); !r.Answer[0].(*dns.A).A.Equal(rIP) {
+		t.Fatal("want the answer from remote")
+	}
+
+	// no rule matched, local is faster
+	if r := query(dns.TypeA, &requestInfo{listener: "127.0.0.1:5353"}); !r.Answer[0].(*dns.A).A.Equal(lIP) {
+		t.Fatal("want the answer from local")
+	}
+}
+
+func Test_dispatcher_ServeDNS_ClientGroups(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	fIP := net.IPv4(1, 1, 1, 3)
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIP, rIP, "0.0.0.0/0", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	// filtering upstream
+	filterUDPConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := dns.Server{PacketConn: filterUDPConn, Handler: &vServer{ip: fIP}}
+	go fs.ActivateAndServe()
+	defer fs.Shutdown()
+	filter, err := newUpstream("filter", &UpstreamConfig{Addr: filterUDPConn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams := map[string]*upstream{"filter": filter}
+
+	leasesFile, err := ioutil.TempFile("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(leasesFile.Name())
+	leasesFile.WriteString("1600000000 aa:bb:cc:dd:ee:ff 192.168.1.10 tablet *\n")
+	leasesFile.Close()
+	d.dhcpLeases, err = newDHCPLeases(leasesFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, gc := range []*ClientGroupConfig{
+		{Name: "kids", MAC: []string{"AA:BB:CC:DD:EE:FF"}, LocalUpstream: "filter"},
+		{Name: "lab", IP: []string{"192.168.2.0/24"}, Rules: []*RuleConfig{{Action: "remote"}}},
+	} {
+		g, err := newClientGroup(gc, upstreams, d, d.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, r := range g.rules {
+			r.id = 100*(i+1) + j
+		}
+		d.clientGroups = append(d.clientGroups, g)
+	}
+
+	for _, tt := range []struct {
+		clientIP net.IP
+		want     net.IP
+	}{
+		{net.IPv4(192, 168, 1, 10), fIP},
+		{net.IPv4(192, 168, 2, 10), rIP},
+		{net.IPv4(192, 168, 3, 10), lIP},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r := d.serveDNS(q, &requestInfo{clientIP: tt.clientIP})
+		if r == nil || len(r.Answer) == 0 {
+			t.Fatal("empty answer")
+		}
+		if !r.Answer[0].(*dns.A).A.Equal(tt.want) {
+			t.Fatalf("client %s: want %s, got %s", tt.clientIP, tt.want, r.Answer[0].(*dns.A).A)
+		}
+	}
+}
+
+func Test_dispatcher_ServeDNS_QtypeRoutes(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIP, rIP, "0.0.0.0/0", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	d.qtypeRoutes, err = newQtypeRoutes(map[string]string{
+		"AAAA":        "empty",
+		"ANY":         "refuse",
+		"PTR":         "remote",
+		"PTR:private": "local",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range d.qtypeRoutes {
+		r.id = i
+	}
+	d.rules = d.qtypeRoutes
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		r := d.serveDNS(q, nil)
+		if r == nil {
+			t.Fatal("nil r")
+		}
+		return r
+	}
+
+	if r := query("example.com.", dns.TypeAAAA); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatal("want an empty answer")
+	}
+	if r := query("example.com.", dns.TypeANY); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want REFUSED, got %s", dns.RcodeToString[r.Rcode])
+	}
+	// vServer always answers A records
+	if r := query("1.1.168.192.in-addr.arpa.", dns.TypePTR); !r.Answer[0].(*dns.A).A.Equal(lIP) {
+		t.Fatal("want the answer from local")
+	}
+	if r := query("8.8.8.8.in-addr.arpa.", dns.TypePTR); !r.Answer[0].(*dns.A).A.Equal(rIP) {
+		t.Fatal("want the answer from remote")
+	}
+}
+
+func Test_dhcpLeases_reload(t *testing.T) {
+	f, err := ioutil.TempFile("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("1600000000 aa:bb:cc:dd:ee:ff 192.168.1.10 tablet *\n")
+	f.Close()
+	l, err := newDHCPLeases(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.168.1.10")
+
+	data := []byte("1600000000 11:22:33:44:55:66 192.168.1.10 tablet *\n")
+	if err := ioutil.WriteFile(f.Name(), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Second)
+	os.Chtimes(f.Name(), modTime, modTime)
+
+	// not checked again within dhcpLeasesReloadInterval
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if mac := l.lookup(ip); mac != "aa:bb:cc:dd:ee:ff" {
+				t.Errorf("unexpected mac %s", mac)
+			}
+		}()
+	}
+	wg.Wait()
+
+	atomic.StoreInt64(&l.lastChecked, 0)
+	if mac := l.lookup(ip); mac != "11:22:33:44:55:66" {
+		t.Fatalf("leases should be reloaded, got %s", mac)
+	}
+}
+
+// qtypeRoutesExample is the qtype_routes example in README.md.
+const qtypeRoutesExample = `{
+    "qtype_routes": {
+        "HTTPS": "remote",
+        "SVCB": "remote",
+        "TXT": "remote",
+        "AAAA": "empty",
+        "ANY": "refuse",
+        "PTR:private": "local"
+    }
+}`
+
+func Test_newQtypeRoutes_Example(t *testing.T) {
+	var table map[string]string
+	if err := json.Unmarshal([]byte(qtypeRoutesExample), &struct {
+		QtypeRoutes *map[string]string `json:"qtype_routes"`
+	}{&table}); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newQtypeRoutes(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != len(table) {
+		t.Fatalf("want %d routes, got %d", len(table), len(routes))
+	}
+	if !routes[0].privateReverse {
+		t.Fatal("PTR:private should be the first route")
+	}
+
+	// the example also works as rule qtypes
+	qtypes := make([]string, 0, len(table))
+	for k := range table {
+		s, _ := trimPrivateSuffix(k)
+		qtypes = append(qtypes, s)
+	}
+	if _, err := newRule("test", &RuleConfig{Qtype: qtypes, Action: "remote"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_newQtypeRoutes_PrivateSuffix(t *testing.T) {
+	for _, k := range []string{"PTR:private", "ptr:PRIVATE", "Ptr:Private"} {
+		routes, err := newQtypeRoutes(map[string]string{k: "local"})
+		if err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+		if r := routes[0]; !r.privateReverse {
+			t.Fatalf("%s: should be restricted to private reverse queries", k)
+		}
+		if _, ok := routes[0].qtypes[dns.TypePTR]; !ok {
+			t.Fatalf("%s: should match PTR", k)
+		}
+	}
+	if _, err := newQtypeRoutes(map[string]string{"PTR:public": "local"}); err == nil {
+		t.Fatal("PTR:public should be invalid")
+	}
+}
+
+func Test_parseQtype(t *testing.T) {
+	for s, want := range map[string]uint16{
+		"A":        dns.TypeA,
+		"aaaa":     dns.TypeAAAA,
+		"HTTPS":    65,
+		"svcb":     64,
+		"TYPE65":   65,
+		"type1234": 1234,
+	} {
+		if got, ok := parseQtype(s); !ok || got != want {
+			t.Errorf("parseQtype(%s) = %d, %v, want %d", s, got, ok, want)
+		}
+	}
+	for _, s := range []string{"", "HTTP", "TYPE", "TYPE65536", "TYPE-1"} {
+		if _, ok := parseQtype(s); ok {
+			t.Errorf("parseQtype(%s) should fail", s)
+		}
+	}
+}
+
+func Test_reverseNameToIP(t *testing.T) {
+	tests := []struct {
+		name string
+		want net.IP
+	}{
+		{"1.1.168.192.in-addr.arpa.", net.IPv4(192, 168, 1, 1)},
+		{"1.168.192.in-addr.arpa.", nil},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", net.ParseIP("fe80::1")},
+		{"example.com.", nil},
+	}
+	for _, tt := range tests {
+		if got := reverseNameToIP(tt.name); !got.Equal(tt.want) {
+			t.Errorf("reverseNameToIP(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_dispatcher_dropLoaclRes_CNAME(t *testing.T) {
+	forced := domainlist.New()
+	forced.Add("cdn.cn.")
+	blocked := domainlist.New()
+	blocked.Add("cdn.com.")
+	allowed, err := ipv6.NewNetListFromReader(bytes.NewReader([]byte("1.1.1.0/24")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dispatcher{
+		localAllowedIPList:     newIPList(allowed),
+		localAllowedDomainList: newDomainList(forced),
+		localBlockedDomainList: newDomainList(blocked),
+		localDropBlockedCNAME:  true,
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	res := func(target string, ip net.IP) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target},
+			&dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: ip},
+		}
+		return r
+	}
+
+	if !d.dropLoaclRes(res("a.cdn.com.", net.IPv4(1, 1, 1, 1)), nil, logger) {
+		t.Fatal("CNAME to a blocked domain should be dropped")
+	}
+	if d.dropLoaclRes(res("a.cdn.cn.", net.IPv4(2, 2, 2, 2)), nil, logger) {
+		t.Fatal("CNAME to a forced domain should be accepted")
+	}
+	if !d.dropLoaclRes(res("a.cdn.net.", net.IPv4(2, 2, 2, 2)), nil, logger) {
+		t.Fatal("IP is not allowed")
+	}
+
+	d.localDropBlockedCNAME = false
+	if d.dropLoaclRes(res("a.cdn.com.", net.IPv4(1, 1, 1, 1)), nil, logger) {
+		t.Fatal("CNAME to a blocked domain should be judged by its IP")
+	}
+	// the forced list is always checked
+	if d.dropLoaclRes(res("a.cdn.cn.", net.IPv4(2, 2, 2, 2)), nil, logger) {
+		t.Fatal("CNAME to a forced domain should be accepted")
+	}
+
+	// without domain lists, only IPs are checked
+	d.localAllowedDomainList, d.localBlockedDomainList = nil, nil
+	if !d.dropLoaclRes(res("a.cdn.cn.", net.IPv4(2, 2, 2, 2)), nil, logger) {
+		t.Fatal("IP is not allowed")
+	}
+}
+
+func Test_dispatcher_ServeDNS_RemoteRequeryLocal(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	d, closeServer, err := initTestDispatherAndServer(time.Millisecond*200, 0, lIP, rIP, "1.1.1.0/24", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	query := func() net.IP {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r := d.serveDNS(q, nil)
+		if r == nil || len(r.Answer) == 0 {
+			t.Fatal("empty answer")
+		}
+		return r.Answer[0].(*dns.A).A
+	}
+
+	if ip := query(); !ip.Equal(rIP) {
+		t.Fatal("remote is faster, want the answer from remote")
+	}
+
+	d.remoteRequeryLocal = true
+	if ip := query(); !ip.Equal(lIP) {
+		t.Fatal("remote answer is in the allowed list, want the answer from local")
+	}
+}
+
+func Test_dispatcher_ServeDNS_Rewrites(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIP, rIP, "0.0.0.0/0", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	for _, rc := range []*RewriteConfig{
+		{Domain: []string{"corp.example"}, IP: []string{"10.0.0.1", "fd00::1"}},
+		{Domain: []string{"full:cdn.blocked.com"}, To: "mirror.example.com"},
+	} {
+		rw, err := newRewrite("test", rc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.rewrites = append(d.rewrites, rw)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		r := d.serveDNS(q, nil)
+		if r == nil {
+			t.Fatal("nil r")
+		}
+		if r.Question[0].Name != name {
+			t.Fatal("question name should be kept")
+		}
+		return r
+	}
+
+	if r := query("www.corp.example.", dns.TypeA); len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatal("invalid fixed A answer")
+	}
+	if r := query("corp.example.", dns.TypeAAAA); len(r.Answer) != 1 || !r.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::1")) {
+		t.Fatal("invalid fixed AAAA answer")
+	}
+
+	r := query("cdn.blocked.com.", dns.TypeA)
+	if len(r.Answer) != 2 {
+		t.Fatalf("want 2 answers, got %d", len(r.Answer))
+	}
+	if cname := r.Answer[0].(*dns.CNAME); cname.Hdr.Name != "cdn.blocked.com." || cname.Target != "mirror.example.com." {
+		t.Fatal("invalid synthesized CNAME")
+	}
+	if a := r.Answer[1].(*dns.A); a.Hdr.Name != "mirror.example.com." || !a.A.Equal(lIP) {
+		t.Fatal("invalid answer of the target")
+	}
+}
+
+func Test_dispatcher_ServeDNS_ForwardZones(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	lIP := net.IPv4(1, 1, 1, 1)
+	rIP := net.IPv4(1, 1, 1, 2)
+	fIP := net.IPv4(10, 0, 0, 1)
+	// the answer of the zone server is not in the allowed list
+	d, closeServer, err := initTestDispatherAndServer(0, time.Millisecond*100, lIP, rIP, "1.1.1.0/24", "")
+	if err != nil {
+		t.Fatalf("init dispather, %v", err)
+	}
+	defer closeServer()
+
+	zoneUDPConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := dns.Server{PacketConn: zoneUDPConn, Handler: &vServer{ip: fIP}}
+	go zs.ActivateAndServe()
+	defer zs.Shutdown()
+
+	r, err := newForwardZone("forward_zones[0]", &ForwardZoneConfig{
+		Zones:          []string{"corp.example", "168.192.in-addr.arpa"},
+		UpstreamConfig: UpstreamConfig{Addr: zoneUDPConn.LocalAddr().String(), Timeout: 1000},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.rules = []*rule{r}
+
+	for name, want := range map[string]net.IP{
+		"www.corp.example.":         fIP,
+		"1.1.168.192.in-addr.arpa.": fIP,
+		"example.com.":              lIP,
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r := d.serveDNS(q, nil)
+		if r == nil || len(r.Answer) == 0 {
+			t.Fatal("empty answer")
+		}
+		if !r.Answer[0].(*dns.A).A.Equal(want) {
+			t.Fatalf("%s: want %s, got %s", name, want, r.Answer[0].(*dns.A).A)
+		}
+	}
+
+	if _, err := newForwardZone("forward_zones[1]", &ForwardZoneConfig{Zones: []string{"lab"}, Upstream: "none"}, nil); err == nil {
+		t.Fatal("unknown upstream should fail")
+	}
+}
@@ -0,0 +1,87 @@
+package domainlist
+
+// acMatcher is an Aho-Corasick automaton that matches
+// multiple keywords in one pass.
+type acMatcher struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  int32 // index+1 of a keyword that ends here or at a node in its fail chain, 0 means none
+}
+
+func newACMatcher(keywords []string) *acMatcher {
+	m := &acMatcher{nodes: make([]acNode, 1, len(keywords)*4+1)}
+
+	for i, k := range keywords {
+		n := int32(0)
+		for j := 0; j < len(k); j++ {
+			c := k[j]
+			next, ok := m.nodes[n].next[c]
+			if !ok {
+				if m.nodes[n].next == nil {
+					m.nodes[n].next = make(map[byte]int32)
+				}
+				m.nodes = append(m.nodes, acNode{})
+				next = int32(len(m.nodes) - 1)
+				m.nodes[n].next[c] = next
+			}
+			n = next
+		}
+		if m.nodes[n].out == 0 {
+			m.nodes[n].out = int32(i + 1)
+		}
+	}
+
+	// build fail links in bfs order
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for {
+				if next, ok := m.nodes[f].next[c]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if m.nodes[child].out == 0 {
+				m.nodes[child].out = m.nodes[m.nodes[child].fail].out
+			}
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// match returns the index of a keyword in s, or -1.
+func (m *acMatcher) match(s string) int {
+	n := int32(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for {
+			if next, ok := m.nodes[n].next[c]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		if out := m.nodes[n].out; out != 0 {
+			return int(out - 1)
+		}
+	}
+	return -1
+}
@@ -0,0 +1,275 @@
+package domainlist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// binary format (big endian):
+//
+//	header:  magic [8]byte | version uint16 | crc32 uint32 | body_len uint32
+//	body:    sources | trie | full | keywords | regexps | exceptions | full_exceptions
+//	sources: count uint32 | (len uint16 | name)...
+//	trie:    domains uint32 | node_count uint32 | node... | labels_len uint32 | labels
+//	node:    label_off uint32 | first_child uint32 | origin uint32 | label_len uint8 | end uint8
+//	entries: count uint32 | (len uint16 | entry | origin uint32)...
+//
+// crc32 is the IEEE checksum of the body. The trie is stored as it is
+// in memory, so loading it needs no parsing, only its index is rebuilt.
+const (
+	binaryMagic   = "MOSDLIST"
+	binaryVersion = 1
+
+	binaryHeaderLen = len(binaryMagic) + 2 + 4 + 4
+	binaryNodeLen   = 4 + 4 + 4 + 1 + 1
+)
+
+// errors of LoadBinary
+var (
+	ErrIncompatibleBinary = errors.New("incompatible binary list")
+	ErrBinaryChecksum     = errors.New("binary list checksum mismatch")
+	ErrCorruptBinary      = errors.New("corrupt binary list")
+)
+
+// WriteBinary writes l to w in the binary format, LoadBinary loads it.
+func (l *List) WriteBinary(w io.Writer) error {
+	l.build()
+
+	var b binWriter
+	b.u32(uint32(len(l.sources)))
+	for _, s := range l.sources {
+		b.str16(s)
+	}
+
+	t := l.domains
+	b.u32(uint32(t.n))
+	b.u32(uint32(len(t.nodes)))
+	for i := range t.nodes {
+		n := &t.nodes[i]
+		b.u32(n.labelOff)
+		b.u32(n.firstChild)
+		b.u32(uint32(n.origin))
+		b.buf = append(b.buf, n.labelLen)
+		if n.end {
+			b.buf = append(b.buf, 1)
+		} else {
+			b.buf = append(b.buf, 0)
+		}
+	}
+	b.u32(uint32(len(t.labels)))
+	b.buf = append(b.buf, t.labels...)
+
+	b.originMap(l.full)
+	b.items(l.keywords)
+	b.items(l.regexps)
+	b.originMap(l.exceptions)
+	b.originMap(l.fullExceptions)
+	if b.err != nil {
+		return b.err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(binaryMagic)
+	binary.Write(bw, binary.BigEndian, uint16(binaryVersion))
+	binary.Write(bw, binary.BigEndian, crc32.ChecksumIEEE(b.buf))
+	binary.Write(bw, binary.BigEndian, uint32(len(b.buf)))
+	bw.Write(b.buf)
+	return bw.Flush()
+}
+
+// LoadBinary loads a list that was written by WriteBinary from data.
+// The list does not reference data after it returns.
+func LoadBinary(data []byte) (*List, error) {
+	if len(data) < binaryHeaderLen || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, ErrIncompatibleBinary
+	}
+	h := data[len(binaryMagic):binaryHeaderLen]
+	if binary.BigEndian.Uint16(h) != binaryVersion {
+		return nil, ErrIncompatibleBinary
+	}
+	body := data[binaryHeaderLen:]
+	if uint64(binary.BigEndian.Uint32(h[6:])) != uint64(len(body)) {
+		return nil, ErrCorruptBinary
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(h[2:]) {
+		return nil, ErrBinaryChecksum
+	}
+
+	r := &binReader{b: body}
+	l := New()
+	for i, n := 0, r.count(2); i < n; i++ {
+		l.sources = append(l.sources, r.str16())
+	}
+
+	t := l.domains
+	t.n = int(r.u32())
+	nodeCount := r.count(binaryNodeLen)
+	if nodeCount != 0 {
+		t.nodes = make([]trieNode, nodeCount)
+		for i := range t.nodes {
+			p := r.next(binaryNodeLen)
+			if p == nil {
+				break
+			}
+			t.nodes[i] = trieNode{
+				labelOff:   binary.BigEndian.Uint32(p),
+				firstChild: binary.BigEndian.Uint32(p[4:]),
+				origin:     origin(binary.BigEndian.Uint32(p[8:])),
+				labelLen:   p[12],
+				end:        p[13] != 0,
+			}
+		}
+	}
+	t.labels = string(r.next(int(r.u32())))
+
+	r.originMap(l.full)
+	l.keywords = r.items()
+	l.regexps = r.items()
+	r.originMap(l.exceptions)
+	r.originMap(l.fullExceptions)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	t.buildIndex()
+	for i := range l.regexps {
+		re, err := compileRegexp(l.regexps[i].s)
+		if err != nil {
+			return nil, ErrCorruptBinary
+		}
+		l.regexps[i].re = re
+	}
+	if len(l.keywords) != 0 || len(l.regexps) != 0 {
+		l.dirty = 1
+	}
+	return l, nil
+}
+
+// validate checks that t is well-formed, so that a corrupt list with
+// a valid checksum won't crash lookups.
+func (t *trie) validate() error {
+	for i := range t.nodes {
+		n := &t.nodes[i]
+		if int(n.firstChild) > len(t.nodes) || (i > 0 && n.firstChild <= uint32(i)) ||
+			uint64(n.labelOff)+uint64(n.labelLen) > uint64(len(t.labels)) {
+			return ErrCorruptBinary
+		}
+		if i > 0 && n.firstChild < t.nodes[i-1].firstChild {
+			return ErrCorruptBinary
+		}
+	}
+	return nil
+}
+
+type binWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *binWriter) u32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *binWriter) str16(s string) {
+	if len(s) > 0xffff {
+		w.err = errors.New("entry is too long")
+		return
+	}
+	w.buf = append(w.buf, byte(len(s)>>8), byte(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// originMap writes entries of m in sorted order, so that the same list
+// is always written in the same bytes.
+func (w *binWriter) originMap(m map[string]origin) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.u32(uint32(len(keys)))
+	for _, k := range keys {
+		w.str16(k)
+		w.u32(uint32(m[k]))
+	}
+}
+
+func (w *binWriter) items(items []item) {
+	w.u32(uint32(len(items)))
+	for _, it := range items {
+		w.str16(it.s)
+		w.u32(uint32(it.origin))
+	}
+}
+
+type binReader struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes, or nil if there are not enough bytes.
+func (r *binReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = ErrCorruptBinary
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *binReader) u32() uint32 {
+	if p := r.next(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+// count reads the number of following elements that are at least
+// minLen bytes each. A count that can't fit in the rest is an error, so
+// a corrupt count won't cause a huge allocation.
+func (r *binReader) count(minLen int) int {
+	n := int(r.u32())
+	if r.err == nil && n > len(r.b)/minLen {
+		r.err = ErrCorruptBinary
+		return 0
+	}
+	return n
+}
+
+func (r *binReader) str16() string {
+	p := r.next(2)
+	if p == nil {
+		return ""
+	}
+	return string(r.next(int(binary.BigEndian.Uint16(p))))
+}
+
+func (r *binReader) originMap(m map[string]origin) {
+	for i, n := 0, r.count(6); i < n; i++ {
+		k := r.str16()
+		m[k] = origin(r.u32())
+	}
+}
+
+func (r *binReader) items() []item {
+	n := r.count(6)
+	if n == 0 {
+		return nil
+	}
+	items := make([]item, n)
+	for i := range items {
+		items[i].s = r.str16()
+		items[i].origin = origin(r.u32())
+	}
+	return items
+}
@@ -0,0 +1,83 @@
+package domainlist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_List_Binary(t *testing.T) {
+	l, err := LoadFormReader(strings.NewReader(`
+example.com
+!cn.example.com
+full:www.google.com
+!full:www.example.com
+keyword:ads
+regexp:^ad[0-9]+\.
+中国
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.full["www.google.com."] = l.addSource("a.list").withLine(5)
+
+	buf := new(bytes.Buffer)
+	if err := l.WriteBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	got, err := LoadBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(got.Len() == l.Len())
+	for domain, want := range map[string]bool{
+		"a.example.com":    true,
+		"a.cn.example.com": false,
+		"www.google.com":   true,
+		"a.www.google.com": false,
+		"www.example.com":  false,
+		"myads.org":        true,
+		"ad1.example.org":  true,
+		"www.中国":           true,
+		"google.com":       false,
+	} {
+		if got.Has(domain) != want {
+			t.Errorf("Has(%s) should be %v", domain, want)
+		}
+	}
+	if m := got.Match("www.google.com"); m == nil || m.Source != "a.list" || m.Line != 5 {
+		t.Errorf("unexpected match %v", m)
+	}
+
+	// the same list is written in the same bytes
+	buf2 := new(bytes.Buffer)
+	if err := got.WriteBinary(buf2); err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(bytes.Equal(data, buf2.Bytes()))
+
+	// empty list
+	buf.Reset()
+	if err := New().WriteBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := LoadBinary(buf.Bytes())
+	if err != nil || empty.Len() != 0 || empty.Has("example.com") {
+		t.Fatal("empty list should be loaded")
+	}
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), data...))
+	}
+	for want, b := range map[error][]byte{
+		ErrIncompatibleBinary: corrupt(func(b []byte) []byte { b[len(binaryMagic)+1]++; return b }),
+		ErrBinaryChecksum:     corrupt(func(b []byte) []byte { b[len(b)-1]++; return b }),
+		ErrCorruptBinary:      corrupt(func(b []byte) []byte { return b[:len(b)-1] }),
+	} {
+		if _, err := LoadBinary(b); err != want {
+			t.Errorf("want %v, got %v", want, err)
+		}
+	}
+}
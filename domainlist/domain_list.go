@@ -2,6 +2,10 @@ package domainlist
 
 import (
 	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
@@ -9,88 +13,364 @@ import (
 // error
 var (
 	ErrInvalidDomainName = errors.New("invalid doamin name")
+	ErrInvalidKeyword    = errors.New("invalid keyword")
+	ErrInvalidException  = errors.New("exceptions can only be domain or full entries")
 )
 
+// MatchType is the type of an entry in the List.
+type MatchType uint8
+
+// match types
+const (
+	MatchDomain  MatchType = iota // matches the domain and its subdomains
+	MatchFull                     // matches the domain only
+	MatchKeyword                  // matches domains that contain the keyword
+	MatchRegexp                   // matches domains that match the regular expression
+)
+
+// prefixes of the entries in list files
+var matchTypePrefixes = [...]string{
+	MatchDomain:  "domain:",
+	MatchFull:    "full:",
+	MatchKeyword: "keyword:",
+	MatchRegexp:  "regexp:",
+}
+
+func (t MatchType) String() string {
+	if int(t) < len(matchTypePrefixes) {
+		return strings.TrimSuffix(matchTypePrefixes[t], ":")
+	}
+	return "unknown"
+}
+
+// exceptionPrefix is the prefix of exception entries, e.g. "!cn.example.com"
+// and "!full:example.com".
+const exceptionPrefix = "!"
+
+// ParseEntry parses an entry like "full:example.com". Entries without a
+// known prefix are MatchDomain entries. Use IsException to check
+// the exception prefix before calling it.
+func ParseEntry(entry string) (MatchType, string) {
+	for t, prefix := range matchTypePrefixes {
+		if strings.HasPrefix(entry, prefix) {
+			return MatchType(t), entry[len(prefix):]
+		}
+	}
+	return MatchDomain, entry
+}
+
+// IsException reports whether entry is an exception like "!cn.example.com".
+// It returns entry without the exception prefix.
+func IsException(entry string) (string, bool) {
+	if strings.HasPrefix(entry, exceptionPrefix) {
+		return entry[len(exceptionPrefix):], true
+	}
+	return entry, false
+}
+
+// List is a list of domain entries. Exceptions exclude domains from
+// the list, see Has for how they are evaluated.
 type List struct {
-	s map[[16]byte]struct{}
-	m map[[32]byte]struct{}
-	l map[[256]byte]struct{}
+	domains *trie             // MatchDomain entries
+	pending map[string]origin // MatchDomain entries that are not in domains yet
+
+	full     map[string]origin
+	keywords []item
+	regexps  []item
+
+	exceptions     map[string]origin // MatchDomain exceptions
+	fullExceptions map[string]origin // MatchFull exceptions
+
+	// files that entries were loaded from, see origin
+	sources []string
+	// origin of entries that are being added
+	origin origin
+
+	// pending domains, keywords and regexps are compiled on the first
+	// call of Has after they were changed.
+	dirty     int32
+	buildLock sync.Mutex
+	ac        *acMatcher
+	re        *regexp.Regexp
+}
+
+// item is a keyword or a regexp.
+type item struct {
+	s      string
+	re     *regexp.Regexp // compiled s of regexps
+	origin origin
 }
 
 func New() *List {
 	return &List{
-		s: make(map[[16]byte]struct{}),
-		m: make(map[[32]byte]struct{}),
-		l: make(map[[256]byte]struct{}),
+		domains: &trie{},
+		pending: make(map[string]origin),
+		full:    make(map[string]origin),
+
+		exceptions:     make(map[string]origin),
+		fullExceptions: make(map[string]origin),
 	}
 }
 
-func (l *List) Add(domain string) error {
+// AddEntry parses entry by IsException and ParseEntry and adds it to the list.
+func (l *List) AddEntry(entry string) error {
+	entry, isException := IsException(entry)
+	t, v := ParseEntry(entry)
+	if isException {
+		return l.AddException(t, v)
+	}
+	return l.AddWithType(t, v)
+}
 
-	if _, ok := dns.IsDomainName(domain); !ok {
+// AddException adds s to the list as a t exception. t can only be
+// MatchDomain or MatchFull.
+func (l *List) AddException(t MatchType, s string) error {
+	var m map[string]origin
+	switch t {
+	case MatchDomain:
+		m = l.exceptions
+	case MatchFull:
+		m = l.fullExceptions
+	default:
+		return ErrInvalidException
+	}
+	s, err := normalizeDomain(s)
+	if err != nil {
+		return err
+	}
+	if !isDomainName(s) {
 		return ErrInvalidDomainName
 	}
-	fqdn := dns.Fqdn(domain)
-	n := len(fqdn)
-
-	switch {
-	case n <= 16 && n > 0:
-		var b [16]byte
-		copy(b[:], fqdn)
-		l.s[b] = struct{}{}
-	case n <= 32 && n > 16:
-		var b [32]byte
-		copy(b[:], fqdn)
-		l.m[b] = struct{}{}
-	case n > 32 && n <= 256:
-		var b [256]byte
-		copy(b[:], fqdn)
-		l.l[b] = struct{}{}
+	m[dns.Fqdn(s)] = l.origin
+	return nil
+}
+
+// AddWithType adds s to the list as a t entry. Domains, keywords and
+// regexps are case-insensitive, see Add.
+func (l *List) AddWithType(t MatchType, s string) error {
+	switch t {
+	case MatchDomain:
+		return l.Add(s)
+	case MatchFull:
+		s, err := normalizeDomain(s)
+		if err != nil {
+			return err
+		}
+		if !isDomainName(s) {
+			return ErrInvalidDomainName
+		}
+		l.full[dns.Fqdn(s)] = l.origin
+	case MatchKeyword:
+		if len(s) == 0 {
+			return ErrInvalidKeyword
+		}
+		l.keywords = append(l.keywords, item{s: lowerASCII(s), origin: l.origin})
+		atomic.StoreInt32(&l.dirty, 1)
+	case MatchRegexp:
+		re, err := compileRegexp(s)
+		if err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, item{s: s, re: re, origin: l.origin})
+		atomic.StoreInt32(&l.dirty, 1)
 	default:
+		return errors.New("unknown match type")
+	}
+	return nil
+}
+
+// Add adds domain to the list as a MatchDomain entry. Domains are stored
+// in lower case, Unicode domains are converted to punycode, e.g. "中国.cn"
+// is stored as "xn--fiqs8s.cn".
+func (l *List) Add(domain string) error {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	if !isDomainName(domain) {
+		return ErrInvalidDomainName
+	}
+	fqdn := dns.Fqdn(domain)
+	if len(fqdn) > 256 {
 		return ErrInvalidDomainName
 	}
 
+	if l.domains.has(fqdn) {
+		return nil
+	}
+	l.pending[fqdn] = l.origin
+	atomic.StoreInt32(&l.dirty, 1)
 	return nil
 }
 
+// Has reports whether domain is in the list. Matching is case-insensitive,
+// including keywords and regexps. If exceptions match domain, the most
+// specific entry wins:
+//  - "!full:" exceptions and full entries match the domain only, they
+//    win over all domain entries. An exception wins over a full entry.
+//  - A longer domain entry or exception wins over a shorter one, e.g.
+//    "www.cn.example.com" is in the list of "example.com", "!cn.example.com"
+//    and "www.cn.example.com", but "a.cn.example.com" is not. An exception
+//    wins over a domain entry of the same domain.
+//  - Keywords and regexps are the least specific, a domain that matches
+//    any exception is not in the list.
 func (l *List) Has(domain string) bool {
+	r, ok := l.lookup(domain)
+	return ok && !r.exception
+}
+
+// lookupResult is the most specific entry that matches a domain.
+type lookupResult struct {
+	t         MatchType
+	exception bool
+	entry     string // fqdn for domain and full entries
+	origin    origin
+}
+
+// lookup returns the most specific entry or exception that matches domain.
+// domain is case-insensitive.
+func (l *List) lookup(domain string) (lookupResult, bool) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return lookupResult{}, false
+	}
 	fqdn := dns.Fqdn(domain)
 	if _, ok := dns.IsDomainName(fqdn); !ok {
-		return false
+		return lookupResult{}, false
+	}
+
+	if o, ok := l.fullExceptions[fqdn]; ok {
+		return lookupResult{t: MatchFull, exception: true, entry: fqdn, origin: o}, true
+	}
+	if o, ok := l.full[fqdn]; ok {
+		return lookupResult{t: MatchFull, entry: fqdn, origin: o}, true
+	}
+
+	l.build()
+	matched, node := l.domains.longestSuffix(fqdn)
+	excepted := longestSuffixIn(l.exceptions, fqdn)
+	if excepted != 0 && excepted >= matched {
+		e := fqdn[len(fqdn)-excepted:]
+		return lookupResult{t: MatchDomain, exception: true, entry: e, origin: l.exceptions[e]}, true
+	}
+	if matched != 0 {
+		return lookupResult{t: MatchDomain, entry: fqdn[len(fqdn)-matched:], origin: l.domains.nodes[node].origin}, true
+	}
+
+	if len(l.keywords) == 0 && len(l.regexps) == 0 {
+		return lookupResult{}, false
 	}
-	e := dns.Split(fqdn)
-	for i := range e {
-		p := e[len(e)-1-i]
-		if l.has(fqdn[p:]) {
-			return true
+	name := strings.TrimSuffix(fqdn, ".")
+	if l.ac != nil {
+		if i := l.ac.match(name); i >= 0 {
+			return lookupResult{t: MatchKeyword, entry: l.keywords[i].s, origin: l.keywords[i].origin}, true
 		}
 	}
-	return false
-}
-
-func (l *List) has(fqdn string) bool {
-	n := len(fqdn)
-	switch {
-	case n <= 16 && n > 0:
-		var b [16]byte
-		copy(b[:], fqdn)
-		_, ok := l.s[b]
-		return ok
-	case n <= 32 && n > 16:
-		var b [32]byte
-		copy(b[:], fqdn)
-		_, ok := l.m[b]
-		return ok
-	case n > 32 && n <= 256:
-		var b [256]byte
-		copy(b[:], fqdn)
-		_, ok := l.l[b]
-		return ok
-	default:
-		return false
+	if l.re != nil {
+		if l.re.MatchString(name) {
+			return lookupResult{t: MatchRegexp}, true
+		}
+		return lookupResult{}, false
+	}
+	for _, re := range l.regexps {
+		if re.re.MatchString(name) {
+			return lookupResult{t: MatchRegexp, entry: re.s, origin: re.origin}, true
+		}
 	}
+	return lookupResult{}, false
+}
+
+// Build compiles l. Has builds l if it was changed, call Build after
+// loading to keep the compile time out of the first call of Has.
+func (l *List) Build() {
+	l.build()
+}
+
+// build compiles pending domains, keywords and regexps if they were changed.
+func (l *List) build() {
+	if atomic.LoadInt32(&l.dirty) == 0 {
+		return
+	}
+
+	l.buildLock.Lock()
+	defer l.buildLock.Unlock()
+	if atomic.LoadInt32(&l.dirty) == 0 {
+		return
+	}
+
+	if len(l.pending) != 0 {
+		l.domains.rangeDomains(func(fqdn string, o origin) {
+			l.pending[fqdn] = o
+		})
+		l.domains = newTrie(l.pending)
+		l.pending = make(map[string]origin)
+	}
+	if len(l.keywords) != 0 {
+		l.ac = newACMatcher(itemStrings(l.keywords))
+	}
+	l.re = nil
+	if len(l.regexps) != 0 {
+		// regexps are valid one by one but may fail to compile as a
+		// whole, e.g. the merged one is too large. If so, they are
+		// matched one by one.
+		if re, err := compileRegexp("(?:" + strings.Join(itemStrings(l.regexps), ")|(?:") + ")"); err == nil {
+			l.re = re
+		}
+	}
+	atomic.StoreInt32(&l.dirty, 0)
 }
 
 func (l *List) Len() int {
-	return len(l.l) + len(l.m) + len(l.s)
+	return l.domains.n + len(l.pending) + len(l.full) + len(l.keywords) + len(l.regexps) +
+		len(l.exceptions) + len(l.fullExceptions)
+}
+
+// isDomainName reports whether s is a valid domain of entries. Only
+// letters, digits, '-', '_' and '.' are allowed, so lines of a broken
+// file, e.g. an html page, are not taken as domains.
+func isDomainName(s string) bool {
+	if _, ok := dns.IsDomainName(s); !ok {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// compileRegexp compiles a case-insensitive regexp. Regexps match
+// domains in lower case, upper-case literals like "^WWW\." still match.
+func compileRegexp(s string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + s)
+}
+
+func itemStrings(items []item) []string {
+	ss := make([]string, len(items))
+	for i := range items {
+		ss[i] = items[i].s
+	}
+	return ss
+}
+
+// longestSuffixIn returns the length of the longest suffix of fqdn that
+// is in m, or 0. Suffixes are fqdn and its parent domains.
+func longestSuffixIn(m map[string]origin, fqdn string) int {
+	if len(m) == 0 {
+		return 0
+	}
+	for s := fqdn; len(s) > 1; {
+		if _, ok := m[s]; ok {
+			return len(s)
+		}
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+	}
+	return 0
 }
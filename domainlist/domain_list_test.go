@@ -1,6 +1,11 @@
 package domainlist
 
 import (
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -27,8 +32,283 @@ func Test_DomainList(t *testing.T) {
 	assertTrue(l.Add(string(make([]byte, 256))) == ErrInvalidDomainName)
 }
 
+func Test_DomainList_MatchType(t *testing.T) {
+	l, err := LoadFormReader(strings.NewReader(`
+# comment
+domain:a.com
+full:b.com
+keyword:googlevideo
+keyword:abc
+keyword:bcd
+regexp:^ad[0-9]+\.
+regexp:\.cn$
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(l.Len() == 7)
+
+	assertTrue(l.Has("a.com"))
+	assertTrue(l.Has("www.a.com"))
+
+	assertTrue(l.Has("b.com"))
+	assertTrue(!l.Has("www.b.com"))
+
+	assertTrue(l.Has("r1---sn-abc.googlevideo.com"))
+	assertTrue(l.Has("googlevideo"))
+	assertTrue(l.Has("xbcd.com"))
+	assertTrue(l.Has("ab.bcd"))
+	assertTrue(!l.Has("google.com"))
+	assertTrue(!l.Has("ab.com"))
+
+	assertTrue(l.Has("ad123.example.com"))
+	assertTrue(!l.Has("www.ad123.example.com"))
+	assertTrue(l.Has("www.example.cn"))
+	assertTrue(!l.Has("www.cn.com"))
+
+	// regexps are case-insensitive
+	assertTrue(l.AddEntry(`regexp:^WWW\.Upper\.`) == nil)
+	assertTrue(l.Has("www.upper.com"))
+	assertTrue(l.Has("WWW.UPPER.COM"))
+
+	assertTrue(l.AddEntry("regexp:(") != nil)
+	assertTrue(l.AddEntry("keyword:") == ErrInvalidKeyword)
+	assertTrue(l.AddEntry("full:") == ErrInvalidDomainName)
+	assertTrue(l.AddEntry("<html>") == ErrInvalidDomainName)
+
+	// keywords added after the first call of Has
+	assertTrue(!l.Has("example.org"))
+	assertTrue(l.AddEntry("keyword:example") == nil)
+	assertTrue(l.Has("example.org"))
+}
+
+func Test_Merge_Compact(t *testing.T) {
+	a, err := LoadFormReader(strings.NewReader(`
+google.com
+www.google.com
+full:example.com
+keyword:ads
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadFormReader(strings.NewReader(`
+google.com
+mail.google.com
+full:google.com
+example.com
+keyword:ads
+regexp:^ad[0-9]+
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Merge(b)
+	assertTrue(a.Len() == 9)
+	assertTrue(a.Compact() == 5)
+	assertTrue(a.Len() == 4)
+
+	assertTrue(a.Has("www.google.com"))
+	assertTrue(a.Has("mail.google.com"))
+	assertTrue(a.Has("www.example.com"))
+	assertTrue(a.Has("myads.com"))
+	assertTrue(a.Has("ad1.org"))
+	assertTrue(!a.Has("google.cn"))
+}
+
+func Test_DomainList_Exception(t *testing.T) {
+	l, err := LoadFormReader(strings.NewReader(`
+example.com
+!cn.example.com
+www.cn.example.com
+!full:www.example.com
+full:a.b.cn.example.com
+!full:x.www.cn.example.com
+keyword:ads
+!ads.org
+org
+!full:org
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(l.Len() == 10)
+
+	for domain, want := range map[string]bool{
+		"example.com":          true,
+		"a.example.com":        true,
+		"cn.example.com":       false, // exception wins over a shorter domain entry
+		"a.cn.example.com":     false,
+		"www.cn.example.com":   true, // domain entry is more specific than the exception
+		"a.www.cn.example.com": true,
+		"x.www.cn.example.com": false, // full exceptions win over domain entries
+		"www.example.com":      false,
+		"a.www.example.com":    true, // full exceptions match the domain only
+		"a.b.cn.example.com":   true, // full entries win over domain exceptions
+		"c.a.b.cn.example.com": false,
+		"myads.com":            true,
+		"ads.org":              false, // keywords are less specific than exceptions
+		"org":                  false,
+		"a.org":                true,
+	} {
+		if l.Has(domain) != want {
+			t.Errorf("Has(%s) should be %v", domain, want)
+		}
+	}
+
+	// an exception wins over a domain entry of the same domain
+	assertTrue(l.Add("cn.example.com") == nil)
+	assertTrue(!l.Has("a.cn.example.com"))
+
+	assertTrue(l.AddEntry("!keyword:abc") == ErrInvalidException)
+	assertTrue(l.AddEntry("!") == ErrInvalidDomainName)
+}
+
+func Test_Compact_Exception(t *testing.T) {
+	l, err := LoadFormReader(strings.NewReader(`
+example.com
+www.example.com
+!cn.example.com
+www.cn.example.com
+a.www.cn.example.com
+full:b.cn.example.com
+full:c.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := New()
+	other.AddEntry("!d.example.com")
+	l.Merge(other)
+
+	// www.example.com, a.www.cn.example.com and full:c.example.com are covered
+	assertTrue(l.Compact() == 3)
+	assertTrue(l.Len() == 5)
+	assertTrue(l.Has("a.www.cn.example.com"))
+	assertTrue(l.Has("b.cn.example.com"))
+	assertTrue(!l.Has("a.cn.example.com"))
+	assertTrue(!l.Has("d.example.com"))
+}
+
 func assertTrue(b bool) {
 	if !b {
 		panic("assert failed")
 	}
 }
+
+func Test_trie(t *testing.T) {
+	l := New()
+	for _, d := range []string{"com", "google.com", "a.b.c.d.example.org", "example.net"} {
+		if err := l.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertTrue(l.Len() == 4)
+	assertTrue(l.Has("anything.com"))
+	assertTrue(l.Has("x.a.b.c.d.example.org"))
+	assertTrue(!l.Has("b.c.d.example.org"))
+	assertTrue(!l.Has("example.org"))
+	assertTrue(l.Has("example.net"))
+	assertTrue(!l.Has("net"))
+
+	// domains added after the first call of Has
+	assertTrue(l.Add("example.org") == nil)
+	assertTrue(l.Add("google.com") == nil)
+	assertTrue(l.Len() == 5)
+	assertTrue(l.Has("www.example.org"))
+	assertTrue(l.Has("www.google.com"))
+
+	var got []string
+	l.rangeDomains(func(fqdn string, _ origin) { got = append(got, fqdn) })
+	assertTrue(len(got) == 5)
+}
+
+func Test_sortTrieEntries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]string, 2000)
+	for i := range keys {
+		b := make([]byte, r.Intn(8))
+		for j := range b {
+			b[j] = "ab.c"[r.Intn(4)]
+		}
+		keys[i] = string(b)
+	}
+	e := make([]trieEntry, len(keys))
+	for i := range keys {
+		e[i].key = keys[i]
+	}
+	sortTrieEntries(e, 0)
+	sort.Strings(keys)
+	for i := range keys {
+		if e[i].key != keys[i] {
+			t.Fatalf("sortTrieEntries: #%d is %q, want %q", i, e[i].key, keys[i])
+		}
+	}
+}
+
+// benchList reads the domains of ../chn_domain.list.
+func benchList(b *testing.B) []string {
+	data, err := ioutil.ReadFile("../chn_domain.list")
+	if err != nil {
+		b.Skip(err)
+	}
+	var domains []string
+	for _, s := range strings.Split(string(data), "\n") {
+		if s = strings.TrimSpace(s); len(s) != 0 {
+			domains = append(domains, s)
+		}
+	}
+	return domains
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+func Benchmark_List_Build(b *testing.B) {
+	domains := benchList(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		before := heapInUse()
+		b.StartTimer()
+		l := New()
+		for _, d := range domains {
+			l.Add(d)
+		}
+		l.build()
+		b.StopTimer()
+		b.ReportMetric(float64(heapInUse()-before)/float64(len(domains)), "B/domain")
+		runtime.KeepAlive(l)
+		b.StartTimer()
+	}
+}
+
+func Benchmark_List_Has(b *testing.B) {
+	domains := benchList(b)
+	queries := make([]string, 1024)
+	for i := range queries {
+		d := domains[i*len(domains)/len(queries)]
+		if i%2 == 0 {
+			queries[i] = "www." + d
+		} else {
+			queries[i] = "www.not-in-the-list-" + d
+		}
+	}
+
+	l := New()
+	for _, d := range domains {
+		l.Add(d)
+	}
+	l.build()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Has(queries[i%len(queries)])
+	}
+}
@@ -0,0 +1,279 @@
+package domainlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Format is the format of a list file.
+type Format uint8
+
+// list formats
+const (
+	FormatAuto      Format = iota // detected by the content
+	FormatPlain                   // one entry per line, see ParseEntry
+	FormatDnsmasq                 // dnsmasq config, e.g. "server=/example.com/114.114.114.114"
+	FormatHosts                   // hosts file, e.g. "0.0.0.0 example.com"
+	FormatAutoProxy               // AutoProxy rules like gfwlist, can be base64 encoded
+	FormatAdblock                 // Adblock style filters, e.g. "||example.com^"
+)
+
+var formatNames = [...]string{
+	FormatAuto:      "auto",
+	FormatPlain:     "plain",
+	FormatDnsmasq:   "dnsmasq",
+	FormatHosts:     "hosts",
+	FormatAutoProxy: "autoproxy",
+	FormatAdblock:   "adblock",
+}
+
+func (f Format) String() string {
+	if int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return "unknown"
+}
+
+// ParseFormat returns the format named s. "gfwlist" is an alias of "autoproxy".
+func ParseFormat(s string) (Format, bool) {
+	if s == "gfwlist" {
+		return FormatAutoProxy, true
+	}
+	for f, name := range formatNames {
+		if s == name {
+			return Format(f), true
+		}
+	}
+	return 0, false
+}
+
+// a lineParser adds the entries in line to l. It returns false if
+// line is valid but has no supported entry.
+type lineParser func(l *List, line string) (bool, error)
+
+var lineParsers = [...]lineParser{
+	FormatPlain:     parsePlainLine,
+	FormatDnsmasq:   parseDnsmasqLine,
+	FormatHosts:     parseHostsLine,
+	FormatAutoProxy: parseAutoProxyLine,
+	FormatAdblock:   parseAdblockLine,
+}
+
+func isComment(f Format, line string) bool {
+	switch f {
+	case FormatAutoProxy:
+		return line[0] == '!' || line[0] == '['
+	case FormatAdblock:
+		return line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "# ")
+	default:
+		return line[0] == '#'
+	}
+}
+
+func parsePlainLine(l *List, line string) (bool, error) {
+	return true, l.AddEntry(line)
+}
+
+// parseDnsmasqLine parses "server=/a.com/b.com/1.2.3.4". "local", "address",
+// "ipset" and "nftset" are also accepted. Other options are ignored.
+func parseDnsmasqLine(l *List, line string) (bool, error) {
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return false, nil
+	}
+	switch line[:i] {
+	case "server", "local", "address", "ipset", "nftset":
+	default:
+		return false, nil
+	}
+	v := line[i+1:]
+	if !strings.HasPrefix(v, "/") {
+		return false, nil
+	}
+	j := strings.LastIndexByte(v, '/')
+	if j == 0 {
+		return false, errors.New("missing the second /")
+	}
+
+	added := false
+	for _, d := range strings.Split(v[1:j], "/") {
+		if len(d) == 0 || d == "#" {
+			continue
+		}
+		if err := l.Add(d); err != nil {
+			return false, err
+		}
+		added = true
+	}
+	return added, nil
+}
+
+// names in hosts files that are not blocked
+var hostsIgnoredNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// parseHostsLine parses "<ip> <name> [aliases...]". Names are MatchFull entries.
+func parseHostsLine(l *List, line string) (bool, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return false, errors.New("invalid ip")
+	}
+	if len(fields) < 2 {
+		return false, errors.New("missing host name")
+	}
+
+	added := false
+	for _, name := range fields[1:] {
+		if _, ok := hostsIgnoredNames[strings.ToLower(name)]; ok {
+			continue
+		}
+		if err := l.AddWithType(MatchFull, name); err != nil {
+			return false, err
+		}
+		added = true
+	}
+	return added, nil
+}
+
+// parseAutoProxyLine parses AutoProxy rules like "||example.com",
+// "|http://example.com/path", ".example.com" and "example.com/path".
+// Exceptions like "@@||example.com" are exceptions of the list.
+// Regexps and rules with wildcards in the host are ignored.
+func parseAutoProxyLine(l *List, line string) (bool, error) {
+	if len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/' {
+		return false, nil
+	}
+	s := line
+	isException := strings.HasPrefix(s, "@@")
+	s = strings.TrimPrefix(s, "@@")
+	s = strings.TrimPrefix(s, "||")
+	s = strings.TrimPrefix(s, "|")
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	s = strings.TrimPrefix(s, ".")
+	if i := strings.IndexAny(s, "/:^?"); i >= 0 {
+		s = s[:i]
+	}
+	if strings.ContainsAny(s, "*%") || !strings.Contains(s, ".") || net.ParseIP(s) != nil {
+		return false, nil
+	}
+	if isException {
+		return true, l.AddException(MatchDomain, s)
+	}
+	return true, l.Add(s)
+}
+
+// parseAdblockLine parses "||example.com^" and "||example.com^$important".
+// Exceptions like "@@||example.com^" are exceptions of the list. Other
+// rules like cosmetic and url rules are ignored.
+func parseAdblockLine(l *List, line string) (bool, error) {
+	isException := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	if !strings.HasPrefix(line, "||") {
+		return false, nil
+	}
+	s := line[2:]
+	if i := strings.IndexByte(s, '$'); i >= 0 {
+		if s[i+1:] != "important" {
+			return false, nil
+		}
+		s = s[:i]
+	}
+	s = strings.TrimSuffix(s, "^")
+	if strings.ContainsAny(s, "/*^|") {
+		return false, nil
+	}
+	if isException {
+		return true, l.AddException(MatchDomain, s)
+	}
+	return true, l.Add(s)
+}
+
+// decodeBase64List decodes a base64 encoded list like gfwlist.
+func decodeBase64List(data []byte) ([]byte, bool) {
+	s := strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, string(data))
+	if len(s) == 0 {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// the number of lines that detectFormat samples
+const detectLines = 100
+
+// detectFormat detects the format of a list by its header or
+// its first lines.
+func detectFormat(data []byte) Format {
+	var votes [len(formatNames)]int
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 0; n < detectLines && s.Scan(); {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "[AutoProxy"):
+			return FormatAutoProxy
+		case strings.HasPrefix(line, "[Adblock"):
+			return FormatAdblock
+		case line[0] == '#' || line[0] == '!':
+			continue
+		}
+		n++
+
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "server=/") || strings.HasPrefix(line, "address=/") ||
+			strings.HasPrefix(line, "ipset=/") || strings.HasPrefix(line, "nftset=/") || strings.HasPrefix(line, "local=/"):
+			votes[FormatDnsmasq]++
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			votes[FormatHosts]++
+		case strings.HasPrefix(line, "||") && strings.Contains(line, "^"), strings.HasPrefix(line, "@@||"):
+			votes[FormatAdblock]++
+		case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "|http"):
+			votes[FormatAutoProxy]++
+		default:
+			votes[FormatPlain]++
+		}
+	}
+
+	f := FormatPlain
+	for i := range votes {
+		if votes[i] > votes[f] {
+			f = Format(i)
+		}
+	}
+	return f
+}
@@ -0,0 +1,135 @@
+package domainlist
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func Test_Load_Formats(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		format  Format
+		want    Format
+		has     []string
+		hasNot  []string
+		invalid []int // line numbers
+		ignored int
+	}{
+		{
+			name:   "plain",
+			data:   "# comment\ncn\nfull:a.com\n\nkeyword:foo\n",
+			want:   FormatPlain,
+			has:    []string{"baidu.cn", "a.com", "foo.net"},
+			hasNot: []string{"www.a.com"},
+		},
+		{
+			name:    "plain with invalid lines",
+			data:    "a.com\nregexp:(\nb.com\n",
+			want:    FormatPlain,
+			has:     []string{"a.com", "b.com"},
+			invalid: []int{2},
+		},
+		{
+			name:    "dnsmasq",
+			data:    "#comment\nserver=/baidu.com/114.114.114.114\nipset=/qq.com/taobao.com/chn\ncache-size=100\nserver=/#/1.1.1.1\n",
+			want:    FormatDnsmasq,
+			has:     []string{"www.baidu.com", "qq.com", "taobao.com"},
+			ignored: 2,
+		},
+		{
+			name:    "hosts",
+			data:    "127.0.0.1 localhost\n0.0.0.0 ads.com tracker.com # comment\n::1 ip6-localhost\n",
+			want:    FormatHosts,
+			has:     []string{"ads.com", "tracker.com"},
+			hasNot:  []string{"www.ads.com", "localhost"},
+			ignored: 2,
+		},
+		{
+			name:    "hosts with invalid lines",
+			data:    "0.0.0.0 a.com\n1.2.3 b.com\n",
+			format:  FormatHosts,
+			want:    FormatHosts,
+			has:     []string{"a.com"},
+			invalid: []int{2},
+		},
+		{
+			name:    "autoproxy",
+			data:    "[AutoProxy 0.2.9]\n! comment\n||google.com\n|http://youtube.com/watch\n.twitter.com\nfacebook.com/path\n@@||cn.google.com\n/^https?:\\/\\/[^\\/]+blogspot\\.(.*)/\nkeyword\n",
+			want:    FormatAutoProxy,
+			has:     []string{"www.google.com", "youtube.com", "twitter.com", "facebook.com"},
+			hasNot:  []string{"keyword", "cn.google.com"},
+			ignored: 2,
+		},
+		{
+			name:   "autoproxy base64",
+			data:   base64.StdEncoding.EncodeToString([]byte("[AutoProxy 0.2.9]\n||google.com\n")),
+			want:   FormatAutoProxy,
+			has:    []string{"google.com"},
+			hasNot: []string{"baidu.com"},
+		},
+		{
+			name:    "adblock",
+			data:    "[Adblock Plus 2.0]\n! comment\n||ads.com^\n||tracker.com^$important\n||img.com^$third-party\n##.banner\n@@||ok.ads.com^\n||a.com/ads/*\n",
+			want:    FormatAdblock,
+			has:     []string{"ads.com", "x.tracker.com"},
+			hasNot:  []string{"img.com", "a.com", "ok.ads.com"},
+			ignored: 3,
+		},
+		{
+			name: "adblock without header",
+			data: "||ads.com^\n||b.com^\n",
+			want: FormatAdblock,
+			has:  []string{"ads.com", "b.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, report, err := Load(strings.NewReader(tt.data), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Format != tt.want {
+				t.Fatalf("format: want %s, got %s", tt.want, report.Format)
+			}
+			for _, d := range tt.has {
+				if !l.Has(d) {
+					t.Errorf("%s should be in the list", d)
+				}
+			}
+			for _, d := range tt.hasNot {
+				if l.Has(d) {
+					t.Errorf("%s should not be in the list", d)
+				}
+			}
+			if len(report.Invalid) != len(tt.invalid) {
+				t.Fatalf("invalid lines: want %v, got %v", tt.invalid, report.Invalid)
+			}
+			for i, e := range report.Invalid {
+				if e.Line != tt.invalid[i] {
+					t.Errorf("invalid lines: want %v, got %v", tt.invalid, report.Invalid)
+				}
+			}
+			if report.Ignored != tt.ignored {
+				t.Errorf("ignored lines: want %d, got %d", tt.ignored, report.Ignored)
+			}
+		})
+	}
+}
+
+func Test_ParseFormat(t *testing.T) {
+	for _, s := range []string{"auto", "plain", "dnsmasq", "hosts", "autoproxy", "adblock"} {
+		f, ok := ParseFormat(s)
+		if !ok || f.String() != s {
+			t.Fatalf("ParseFormat(%s) failed", s)
+		}
+	}
+	if f, ok := ParseFormat("gfwlist"); !ok || f != FormatAutoProxy {
+		t.Fatal("gfwlist should be autoproxy")
+	}
+	if _, ok := ParseFormat("/path/to/file"); ok {
+		t.Fatal("ParseFormat should fail")
+	}
+}
@@ -0,0 +1,160 @@
+package domainlist
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var errPunycodeOverflow = errors.New("punycode overflow")
+
+// normalizeDomain returns domain in lower case. Unicode labels are
+// converted to punycode, e.g. "中国" to "xn--fiqs8s".
+func normalizeDomain(domain string) (string, error) {
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= utf8.RuneSelf {
+			return idnToASCII(domain)
+		}
+	}
+	return lowerASCII(domain), nil
+}
+
+// lowerASCII returns s with ASCII letters in lower case. It only
+// allocates if s has upper case letters.
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; 'A' <= c && c <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if c := b[j]; 'A' <= c && c <= 'Z' {
+					b[j] = c + 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// ideographic full stops that are label separators in IDNs
+var idnDots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+// idnToASCII converts an IDN to its ASCII form.
+func idnToASCII(domain string) (string, error) {
+	if !utf8.ValidString(domain) {
+		return "", ErrInvalidDomainName
+	}
+	labels := strings.Split(idnDots.Replace(domain), ".")
+	for i, label := range labels {
+		label = strings.ToLower(label)
+		labels[i] = label
+		for j := 0; j < len(label); j++ {
+			if label[j] >= utf8.RuneSelf {
+				encoded, err := punycodeEncode(label)
+				if err != nil {
+					return "", err
+				}
+				labels[i] = "xn--" + encoded
+				break
+			}
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// punycode parameters, see RFC 3492 section 5.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeEncode encodes s by the algorithm in RFC 3492 section 6.3.
+func punycodeEncode(s string) (string, error) {
+	runes := []rune(s)
+	out := make([]byte, 0, len(s))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for h < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (1<<31-1-delta)/(h+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+				if delta < 0 {
+					return "", errPunycodeOverflow
+				}
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
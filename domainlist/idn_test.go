@@ -0,0 +1,76 @@
+package domainlist
+
+import "testing"
+
+func Test_punycodeEncode(t *testing.T) {
+	for s, want := range map[string]string{
+		"中国":      "fiqs8s",
+		"例子":      "fsqu00a",
+		"münchen": "mnchen-3ya",
+		"bücher":  "bcher-kva",
+		"中文网":     "fiq228c5hs",
+	} {
+		got, err := punycodeEncode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("punycodeEncode(%s) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func Test_normalizeDomain(t *testing.T) {
+	for s, want := range map[string]string{
+		"example.com":    "example.com",
+		"WWW.Baidu.COM.": "www.baidu.com.",
+		"中国":             "xn--fiqs8s",
+		"www.例子.中国":      "www.xn--fsqu00a.xn--fiqs8s",
+		"WWW.MÜNCHEN.de": "www.xn--mnchen-3ya.de",
+		"百度。中国":          "xn--wxtr44c.xn--fiqs8s",
+		"xn--fiqs8s.cn":  "xn--fiqs8s.cn",
+	} {
+		got, err := normalizeDomain(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("normalizeDomain(%s) = %s, want %s", s, got, want)
+		}
+	}
+
+	if _, err := normalizeDomain("\xff.cn"); err == nil {
+		t.Error("invalid utf8 should be rejected")
+	}
+}
+
+func Test_DomainList_CaseInsensitive(t *testing.T) {
+	l := New()
+	assertTrue(l.Add("baidu.com") == nil)
+	assertTrue(l.AddEntry("full:QQ.com") == nil)
+	assertTrue(l.AddEntry("keyword:GoogleVideo") == nil)
+	assertTrue(l.AddEntry("!Map.Baidu.com") == nil)
+	assertTrue(l.AddEntry("中国") == nil)
+	assertTrue(l.AddEntry("full:例子.测试") == nil)
+
+	for domain, want := range map[string]bool{
+		"WWW.Baidu.COM":               true,
+		"www.baidu.com.":              true,
+		"qq.COM":                      true,
+		"www.qq.com":                  false,
+		"r1.GOOGLEVIDEO.com":          true,
+		"a.MAP.baidu.com":             false,
+		"www.xn--fiqs8s":              true,
+		"WWW.XN--FIQS8S":              true,
+		"www.中国":                      true,
+		"xn--fsqu00a.xn--0zwm56d":     true,
+		"www.xn--fsqu00a.xn--0zwm56d": false,
+	} {
+		if l.Has(domain) != want {
+			t.Errorf("Has(%s) should be %v", domain, want)
+		}
+	}
+
+	m := l.Match("WWW.Baidu.COM")
+	assertTrue(m != nil && m.Entry == "baidu.com")
+}
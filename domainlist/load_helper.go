@@ -2,39 +2,115 @@ package domainlist
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 )
 
+// LineError is an invalid line in a list file.
+type LineError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d [%s]: %v", e.Line, e.Text, e.Err)
+}
+
+// LoadReport describes the result of Load.
+type LoadReport struct {
+	Format  Format       // the format of the list, detected if it was FormatAuto
+	Invalid []*LineError // invalid lines, they were skipped
+	Ignored int          // valid lines that have no supported entry, e.g. url rules of Adblock filters
+}
+
 func LoadFormFile(file string) (*List, error) {
-	f, err := os.Open(file)
+	l, _, err := LoadFile(file, FormatAuto)
+	return l, err
+}
+
+// LoadFormReader loads a list from r, the format is detected. Invalid
+// lines are skipped, use Load to get them.
+func LoadFormReader(r io.Reader) (*List, error) {
+	l, _, err := Load(r, FormatAuto)
+	return l, err
+}
+
+// LoadFile loads a list in format f from file. Entries remember their
+// line numbers in file, see Match.
+func LoadFile(file string, f Format) (*List, *LoadReport, error) {
+	fd, err := os.Open(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
+	defer fd.Close()
 
-	return LoadFormReader(f)
+	return load(fd, f, file)
 }
 
-func LoadFormReader(r io.Reader) (*List, error) {
-	l := New()
+// Load loads a list in format f from r. If f is FormatAuto, the format
+// is detected by the content. Invalid lines are skipped and reported.
+func Load(r io.Reader, f Format) (*List, *LoadReport, error) {
+	return load(r, f, "")
+}
+
+// load loads a list from r. name is the source of entries, it can be empty.
+func load(r io.Reader, f Format, name string) (*List, *LoadReport, error) {
+	if int(f) >= len(formatNames) {
+		return nil, nil, fmt.Errorf("unknown format %d", f)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f == FormatAuto || f == FormatAutoProxy {
+		// gfwlist is base64 encoded
+		if b, ok := decodeBase64List(data); ok && (f == FormatAutoProxy || bytes.HasPrefix(b, []byte("[AutoProxy"))) {
+			data = b
+			f = FormatAutoProxy
+		}
+	}
+	if f == FormatAuto {
+		f = detectFormat(data)
+	}
 
-	s := bufio.NewScanner(r)
+	l := New()
+	var src origin
+	if len(name) != 0 {
+		src = l.addSource(name)
+	}
+	report := &LoadReport{Format: f}
+	parse := lineParsers[f]
+	s := bufio.NewScanner(bytes.NewReader(data))
+	lineCounter := 0
 	for s.Scan() {
+		lineCounter++
 		line := strings.TrimSpace(s.Text())
 
-		//ignore lines begin with # and empty lines
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
+		//ignore empty lines and comments
+		if len(line) == 0 || isComment(f, line) {
 			continue
 		}
 
-		err := l.Add(line)
-		if err != nil {
-			return nil, fmt.Errorf("invaild domain [%s], err: [%v]", line, err)
+		l.origin = src.withLine(lineCounter)
+		ok, err := parse(l, line)
+		switch {
+		case err != nil:
+			report.Invalid = append(report.Invalid, &LineError{Line: lineCounter, Text: line, Err: err})
+		case !ok:
+			report.Ignored++
 		}
 	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
 
-	return l, nil
+	l.origin = 0
+	l.build()
+	return l, report, nil
 }
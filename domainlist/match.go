@@ -0,0 +1,135 @@
+package domainlist
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// origin is where an entry was loaded from. The high 12 bits are the
+// index of the source file plus one, the low 20 bits are the line number.
+// Zero means unknown.
+type origin uint32
+
+const (
+	originLineBits  = 20
+	maxOriginLine   = 1<<originLineBits - 1
+	maxOriginSource = 1<<(32-originLineBits) - 1
+)
+
+// addSource adds a source file to l and returns its origin with line 0.
+// If there are too many sources, the origin is unknown.
+func (l *List) addSource(name string) origin {
+	for i, s := range l.sources {
+		if s == name {
+			return origin(i+1) << originLineBits
+		}
+	}
+	if len(l.sources) >= maxOriginSource {
+		return 0
+	}
+	l.sources = append(l.sources, name)
+	return origin(len(l.sources)) << originLineBits
+}
+
+// withLine returns o with line. The line is unknown if it is too large.
+func (o origin) withLine(line int) origin {
+	if o == 0 || line > maxOriginLine {
+		return o &^ maxOriginLine
+	}
+	return o&^maxOriginLine | origin(line)
+}
+
+func (o origin) source(l *List) string {
+	if i := int(o >> originLineBits); i > 0 && i <= len(l.sources) {
+		return l.sources[i-1]
+	}
+	return ""
+}
+
+func (o origin) line() int {
+	return int(o & maxOriginLine)
+}
+
+// originMapper maps origins of another list to l.
+type originMapper struct {
+	l       *List
+	other   *List
+	mapping map[origin]origin
+}
+
+func (m *originMapper) mapOrigin(o origin) origin {
+	src := o &^ maxOriginLine
+	if src == 0 {
+		return o
+	}
+	newSrc, ok := m.mapping[src]
+	if !ok {
+		newSrc = m.l.addSource(o.source(m.other))
+		m.mapping[src] = newSrc
+	}
+	return newSrc.withLine(o.line())
+}
+
+// Match is an entry of a List that matched a domain.
+type Match struct {
+	Type      MatchType
+	Exception bool   // the entry is an exception, the domain is not in the list
+	Entry     string // the domain, keyword or regexp of the entry
+
+	Source string // the file that the entry was loaded from, empty if unknown
+	Line   int    // the line number in Source, 0 if unknown
+}
+
+func (m *Match) String() string {
+	var b strings.Builder
+	if m.Exception {
+		b.WriteString(exceptionPrefix)
+	}
+	b.WriteString(matchTypePrefixes[m.Type])
+	b.WriteString(m.Entry)
+	if len(m.Source) != 0 {
+		if m.Line != 0 {
+			fmt.Fprintf(&b, " (%s:%d)", m.Source, m.Line)
+		} else {
+			fmt.Fprintf(&b, " (%s)", m.Source)
+		}
+	}
+	return b.String()
+}
+
+// Match returns the most specific entry that matches domain, or nil.
+// It can be an exception, then domain is not in the list. See Has for
+// how entries are evaluated.
+func (l *List) Match(domain string) *Match {
+	r, ok := l.lookup(domain)
+	if !ok {
+		return nil
+	}
+
+	m := &Match{Type: r.t, Exception: r.exception, Entry: r.entry}
+	switch r.t {
+	case MatchDomain, MatchFull:
+		if r.entry != "." {
+			m.Entry = strings.TrimSuffix(r.entry, ".")
+		}
+	case MatchRegexp:
+		if len(r.entry) != 0 {
+			break
+		}
+		// regexps were merged, find the first one that matches
+		domain, _ := normalizeDomain(domain)
+		name := strings.TrimSuffix(dns.Fqdn(domain), ".")
+		for _, re := range l.regexps {
+			if re.re.MatchString(name) {
+				m.Entry = re.s
+				r.origin = re.origin
+				break
+			}
+		}
+	}
+	m.Source = r.origin.source(l)
+	m.Line = r.origin.line()
+	return m
+}
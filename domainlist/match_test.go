@@ -0,0 +1,85 @@
+package domainlist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_List_Match(t *testing.T) {
+	dir, err := ioutil.TempDir("", "domainlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileA := filepath.Join(dir, "a.list")
+	fileB := filepath.Join(dir, "b.list")
+	if err := ioutil.WriteFile(fileA, []byte("# comment\nexample.com\n!cn.example.com\nfull:www.google.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileB, []byte("keyword:ads\nregexp:^ad[0-9]+\\.\nregexp:^tracker\\.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, _, err := LoadFile(fileA, FormatPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := LoadFile(fileB, FormatPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Merge(b)
+	a.Compact()
+
+	tests := []struct {
+		domain string
+		want   Match
+	}{
+		{"www.example.com.", Match{Type: MatchDomain, Entry: "example.com", Source: fileA, Line: 2}},
+		{"a.cn.example.com", Match{Type: MatchDomain, Exception: true, Entry: "cn.example.com", Source: fileA, Line: 3}},
+		{"www.google.com", Match{Type: MatchFull, Entry: "www.google.com", Source: fileA, Line: 4}},
+		{"myads.org", Match{Type: MatchKeyword, Entry: "ads", Source: fileB, Line: 1}},
+		{"tracker.org", Match{Type: MatchRegexp, Entry: `^tracker\.`, Source: fileB, Line: 3}},
+	}
+	for _, tt := range tests {
+		m := a.Match(tt.domain)
+		if m == nil || *m != tt.want {
+			t.Errorf("Match(%s): want %v, got %v", tt.domain, &tt.want, m)
+		}
+		if a.Has(tt.domain) == tt.want.Exception {
+			t.Errorf("Has(%s) should be %v", tt.domain, !tt.want.Exception)
+		}
+	}
+	if m := a.Match("google.com"); m != nil {
+		t.Errorf("Match(google.com) should be nil, got %v", m)
+	}
+
+	if s := (&Match{Type: MatchDomain, Exception: true, Entry: "cn.example.com", Source: "a.list", Line: 3}).String(); s != "!domain:cn.example.com (a.list:3)" {
+		t.Errorf("unexpected String() %s", s)
+	}
+
+	// regexps that can't be merged are matched one by one
+	a.build()
+	a.re = nil
+	if m := a.Match("tracker.example.org"); m == nil || m.Entry != `^tracker\.` || m.Line != 3 {
+		t.Errorf("Match(tracker.example.org): unexpected %v", m)
+	}
+	if a.Has("www.tracker.org") {
+		t.Error("Has(www.tracker.org) should be false")
+	}
+
+	// entries added without a source
+	l, err := LoadFormReader(strings.NewReader("example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add("example.org")
+	for _, d := range []string{"example.com", "example.org"} {
+		if m := l.Match(d); m == nil || len(m.Source) != 0 || m.Line != 0 {
+			t.Errorf("Match(%s): unexpected %v", d, m)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package domainlist
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Merge adds all entries of other to l. Entries that are already in l
+// keep their origins.
+func (l *List) Merge(other *List) {
+	m := &originMapper{l: l, other: other, mapping: make(map[origin]origin)}
+	other.rangeDomains(func(fqdn string, o origin) {
+		if l.domains.has(fqdn) {
+			return
+		}
+		if _, ok := l.pending[fqdn]; !ok {
+			l.pending[fqdn] = m.mapOrigin(o)
+			atomic.StoreInt32(&l.dirty, 1)
+		}
+	})
+	mergeOrigins(l.full, other.full, m)
+	mergeOrigins(l.exceptions, other.exceptions, m)
+	mergeOrigins(l.fullExceptions, other.fullExceptions, m)
+	if len(other.keywords) != 0 || len(other.regexps) != 0 {
+		for _, k := range other.keywords {
+			l.keywords = append(l.keywords, item{s: k.s, origin: m.mapOrigin(k.origin)})
+		}
+		for _, re := range other.regexps {
+			l.regexps = append(l.regexps, item{s: re.s, re: re.re, origin: m.mapOrigin(re.origin)})
+		}
+		atomic.StoreInt32(&l.dirty, 1)
+	}
+}
+
+func mergeOrigins(dst, src map[string]origin, m *originMapper) {
+	for fqdn, o := range src {
+		if _, ok := dst[fqdn]; !ok {
+			dst[fqdn] = m.mapOrigin(o)
+		}
+	}
+}
+
+// Compact removes duplicate entries and entries that are covered by
+// another domain entry, e.g. "www.google.com" and "full:google.com" are
+// covered by "google.com". An entry is not covered if an exception is
+// between them, e.g. "www.cn.google.com" is kept if there is
+// "!cn.google.com". It returns the number of removed entries.
+func (l *List) Compact() int {
+	removed := 0
+
+	domains := make(map[string]origin, l.domains.n+len(l.pending))
+	l.rangeDomains(func(fqdn string, o origin) {
+		domains[fqdn] = o
+	})
+	var covered []string
+	for fqdn := range domains {
+		if l.hasParentIn(domains, fqdn) {
+			covered = append(covered, fqdn)
+		}
+	}
+	for _, fqdn := range covered {
+		delete(domains, fqdn)
+	}
+	removed += len(covered)
+
+	for fqdn := range l.full {
+		if _, ok := l.fullExceptions[fqdn]; ok {
+			continue
+		}
+		if _, ok := l.exceptions[fqdn]; ok {
+			continue
+		}
+		if _, ok := domains[fqdn]; ok || l.hasParentIn(domains, fqdn) {
+			delete(l.full, fqdn)
+			removed++
+		}
+	}
+
+	l.buildLock.Lock()
+	l.domains = newTrie(domains)
+	l.pending = make(map[string]origin)
+	l.buildLock.Unlock()
+
+	var kn, rn int
+	l.keywords, kn = uniqueItems(l.keywords)
+	l.regexps, rn = uniqueItems(l.regexps)
+	removed += kn + rn
+	if kn+rn != 0 {
+		atomic.StoreInt32(&l.dirty, 1)
+	}
+	return removed
+}
+
+// rangeDomains calls f with every MatchDomain entry in l.
+func (l *List) rangeDomains(f func(fqdn string, o origin)) {
+	l.domains.rangeDomains(f)
+	for fqdn, o := range l.pending {
+		f(fqdn, o)
+	}
+}
+
+// hasParentIn reports whether a parent domain of fqdn is in domains, and
+// no exception of l is between them.
+func (l *List) hasParentIn(domains map[string]origin, fqdn string) bool {
+	if _, ok := l.exceptions[fqdn]; ok {
+		return false
+	}
+	for i := strings.IndexByte(fqdn, '.'); i >= 0 && i+1 < len(fqdn); i = strings.IndexByte(fqdn, '.') {
+		fqdn = fqdn[i+1:]
+		if _, ok := domains[fqdn]; ok {
+			return true
+		}
+		if _, ok := l.exceptions[fqdn]; ok {
+			return false
+		}
+	}
+	return false
+}
+
+// uniqueItems removes items with duplicate strings and keeps the order.
+// It returns the number of removed items.
+func uniqueItems(items []item) ([]item, int) {
+	seen := make(map[string]struct{}, len(items))
+	out := items[:0]
+	for _, it := range items {
+		if _, ok := seen[it.s]; ok {
+			continue
+		}
+		seen[it.s] = struct{}{}
+		out = append(out, it)
+	}
+	return out, len(items) - len(out)
+}
@@ -0,0 +1,289 @@
+package domainlist
+
+import (
+	"strings"
+)
+
+// trie is a read-only reversed-label trie. "www.google.com." is stored
+// as com -> google -> www. Nodes are stored in one slice, children of a
+// node are contiguous, labels are stored in one string. Children of nodes[i] are nodes[nodes[i].firstChild:nodes[i+1].firstChild].
+// A child is found by index, an open addressing hash table of nodes by
+// their parents and labels.
+type trie struct {
+	nodes  []trieNode // nodes[0] is the root
+	labels string
+	index  []uint32 // indexes of nodes, 0 is empty
+	n      int      // number of domains
+}
+
+type trieNode struct {
+	labelOff   uint32
+	firstChild uint32
+	origin     origin // origin of the domain that ends here
+	labelLen   uint8
+	end        bool // a domain ends here
+}
+
+func (t *trie) label(n *trieNode) string {
+	return t.labels[n.labelOff : n.labelOff+uint32(n.labelLen)]
+}
+
+// children returns the range of the children of nodes[i].
+func (t *trie) children(i uint32) (uint32, uint32) {
+	if int(i)+1 < len(t.nodes) {
+		return t.nodes[i].firstChild, t.nodes[i+1].firstChild
+	}
+	return t.nodes[i].firstChild, uint32(len(t.nodes))
+}
+
+// trieHash is the FNV-1a hash of the parent index and the label.
+func trieHash(parent uint32, label string) uint32 {
+	h := (2166136261 ^ parent) * 16777619
+	for i := 0; i < len(label); i++ {
+		h = (h ^ uint32(label[i])) * 16777619
+	}
+	return h
+}
+
+// buildIndex builds the index of nodes. The index has at least 1.5 times
+// as many slots as nodes.
+func (t *trie) buildIndex() {
+	size := 1
+	for size < len(t.nodes)+len(t.nodes)/2 {
+		size <<= 1
+	}
+	t.index = make([]uint32, size)
+	mask := uint32(size - 1)
+	for i := range t.nodes {
+		first, last := t.children(uint32(i))
+		for c := first; c < last; c++ {
+			h := trieHash(uint32(i), t.label(&t.nodes[c])) & mask
+			for t.index[h] != 0 {
+				h = (h + 1) & mask
+			}
+			t.index[h] = c
+		}
+	}
+}
+
+// child returns the index of the child of nodes[i] that has label, or 0.
+func (t *trie) child(i uint32, label string) uint32 {
+	lo, hi := t.children(i)
+	if lo == hi {
+		return 0
+	}
+	mask := uint32(len(t.index) - 1)
+	for h := trieHash(i, label) & mask; ; h = (h + 1) & mask {
+		c := t.index[h]
+		if c == 0 {
+			return 0
+		}
+		if c >= lo && c < hi && t.label(&t.nodes[c]) == label {
+			return c
+		}
+	}
+}
+
+// lastLabel returns the last label of s[:end] and the index of the dot
+// before it, or -1 if it is the first label.
+func lastLabel(s string, end int) (string, int) {
+	i := strings.LastIndexByte(s[:end], '.')
+	return s[i+1 : end], i
+}
+
+// longestSuffix returns the length of the longest suffix of fqdn that
+// is in t and the index of its node, or 0. Suffixes are fqdn and its
+// parent domains.
+func (t *trie) longestSuffix(fqdn string) (int, uint32) {
+	if len(t.nodes) == 0 {
+		return 0, 0
+	}
+	longest, node := 0, uint32(0)
+	end := len(fqdn) - 1 // skip the root dot
+	i := uint32(0)
+	for end > 0 {
+		label, dot := lastLabel(fqdn, end)
+		if i = t.child(i, label); i == 0 {
+			break
+		}
+		if t.nodes[i].end {
+			longest, node = len(fqdn)-dot-1, i
+		}
+		end = dot
+	}
+	return longest, node
+}
+
+// has reports whether fqdn is in t.
+func (t *trie) has(fqdn string) bool {
+	if len(t.nodes) == 0 {
+		return false
+	}
+	end := len(fqdn) - 1
+	i := uint32(0)
+	for end > 0 {
+		label, dot := lastLabel(fqdn, end)
+		if i = t.child(i, label); i == 0 {
+			return false
+		}
+		end = dot
+	}
+	return i != 0 && t.nodes[i].end
+}
+
+// rangeDomains calls f with every domain in t.
+func (t *trie) rangeDomains(f func(fqdn string, o origin)) {
+	if len(t.nodes) == 0 {
+		return
+	}
+	var walk func(i uint32, suffix string)
+	walk = func(i uint32, suffix string) {
+		first, last := t.children(i)
+		for c := first; c < last; c++ {
+			name := t.label(&t.nodes[c]) + "." + suffix
+			if t.nodes[c].end {
+				f(name, t.nodes[c].origin)
+			}
+			walk(c, name)
+		}
+	}
+	walk(0, "")
+}
+
+// trieEntry is a domain with reversed labels used by newTrie.
+type trieEntry struct {
+	key    string
+	origin origin
+}
+
+// sortTrieEntries sorts e by keys whose first d bytes are the same. It
+// is a multikey quicksort, reversed fqdns share long prefixes like "com.",
+// so common prefixes are not compared again and again.
+func sortTrieEntries(e []trieEntry, d int) {
+	for len(e) > 12 {
+		pivot := keyByte(e[len(e)/2].key, d)
+		lt, i, gt := 0, 0, len(e)
+		for i < gt {
+			switch c := keyByte(e[i].key, d); {
+			case c < pivot:
+				e[lt], e[i] = e[i], e[lt]
+				lt++
+				i++
+			case c > pivot:
+				gt--
+				e[gt], e[i] = e[i], e[gt]
+			default:
+				i++
+			}
+		}
+		sortTrieEntries(e[:lt], d)
+		sortTrieEntries(e[gt:], d)
+		if pivot < 0 {
+			return // keys ended, they are the same
+		}
+		e = e[lt:gt]
+		d++
+	}
+	for i := 1; i < len(e); i++ {
+		for j := i; j > 0 && e[j].key[d:] < e[j-1].key[d:]; j-- {
+			e[j], e[j-1] = e[j-1], e[j]
+		}
+	}
+}
+
+// keyByte returns s[d], or -1 if s is shorter.
+func keyByte(s string, d int) int {
+	if d < len(s) {
+		return int(s[d])
+	}
+	return -1
+}
+
+// newTrie builds a trie from fqdns. The labels of fqdns are reversed and
+// sorted, so domains under a node are contiguous, and nodes are built
+// level by level from ranges of them.
+func newTrie(fqdns map[string]origin) *trie {
+	t := &trie{}
+	if len(fqdns) == 0 {
+		return t
+	}
+
+	// reversed fqdns are in one string, "www.google.com." is "com.google.www.".
+	// The builder never grows, so keys are substrings of it.
+	size := 0
+	for fqdn := range fqdns {
+		size += len(fqdn)
+	}
+	var reversed strings.Builder
+	reversed.Grow(size)
+	entries := make([]trieEntry, 0, len(fqdns))
+	for fqdn, o := range fqdns {
+		off := reversed.Len()
+		for end := len(fqdn) - 1; end > 0; {
+			label, dot := lastLabel(fqdn, end)
+			reversed.WriteString(label)
+			reversed.WriteByte('.')
+			end = dot
+		}
+		entries = append(entries, trieEntry{key: reversed.String()[off:], origin: o})
+	}
+	sortTrieEntries(entries, 0)
+
+	// count nodes and label bytes, an entry adds the labels that are not
+	// shared with the previous one.
+	nodeCount, labelLen := 1, 0
+	prev := ""
+	for i := range entries {
+		k := entries[i].key
+		n := 0
+		for n < len(k) && n < len(prev) && k[n] == prev[n] {
+			n++
+		}
+		added := k[strings.LastIndexByte(k[:n], '.')+1:]
+		dots := strings.Count(added, ".")
+		nodeCount += dots
+		labelLen += len(added) - dots
+		prev = k
+	}
+
+	// nodes in bfs order, spans[i] is the range of entries under nodes[i]
+	// and the length of their common prefix. An entry that is the prefix
+	// itself is the first one, it ends at the node.
+	type span struct {
+		lo, hi uint32
+		pos    uint32
+	}
+	var labels strings.Builder
+	labels.Grow(labelLen)
+	t.nodes = make([]trieNode, 1, nodeCount)
+	spans := make([]span, 1, nodeCount)
+	spans[0] = span{lo: 0, hi: uint32(len(entries))}
+	for i := 0; i < len(t.nodes); i++ {
+		sp := spans[i]
+		t.nodes[i].firstChild = uint32(len(t.nodes))
+		j := sp.lo
+		if j < sp.hi && uint32(len(entries[j].key)) == sp.pos {
+			t.nodes[i].end = true
+			t.nodes[i].origin = entries[j].origin
+			t.n++
+			j++
+		}
+		for j < sp.hi {
+			k := entries[j].key
+			label := k[sp.pos : sp.pos+uint32(strings.IndexByte(k[sp.pos:], '.'))]
+			pos := sp.pos + uint32(len(label)) + 1
+			prefix := k[:pos]
+			lo := j
+			for j < sp.hi && strings.HasPrefix(entries[j].key, prefix) {
+				j++
+			}
+
+			t.nodes = append(t.nodes, trieNode{labelOff: uint32(labels.Len()), labelLen: uint8(len(label))})
+			labels.WriteString(label)
+			spans = append(spans, span{lo: lo, hi: j, pos: pos})
+		}
+	}
+	t.labels = labels.String()
+	t.buildIndex()
+	return t
+}
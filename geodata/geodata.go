@@ -0,0 +1,317 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package geodata loads V2Ray geosite.dat and geoip.dat files.
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+)
+
+// prefixes of references
+const (
+	GeoSitePrefix = "geosite:"
+	GeoIPPrefix   = "geoip:"
+
+	defaultGeoSiteFile = "geosite.dat"
+	defaultGeoIPFile   = "geoip.dat"
+)
+
+// Ref is a reference to an entry in a .dat file.
+type Ref struct {
+	File  string
+	Tag   string
+	Attrs []string
+}
+
+// ParseRef parses a reference like "geosite:cn", "geosite:cn@ads" or
+// "geoip:/path/to/geoip.dat:cn". If the file is omitted, it will be
+// geosite.dat or geoip.dat in the working directory.
+// ok is false if s is not a reference.
+func ParseRef(s string) (ref Ref, ok bool) {
+	var body string
+	switch {
+	case strings.HasPrefix(s, GeoSitePrefix):
+		ref.File = defaultGeoSiteFile
+		body = s[len(GeoSitePrefix):]
+	case strings.HasPrefix(s, GeoIPPrefix):
+		ref.File = defaultGeoIPFile
+		body = s[len(GeoIPPrefix):]
+	default:
+		return ref, false
+	}
+
+	if i := strings.LastIndexByte(body, ':'); i >= 0 {
+		ref.File, body = body[:i], body[i+1:]
+	}
+	sub := strings.Split(body, "@")
+	ref.Tag = sub[0]
+	for _, attr := range sub[1:] {
+		if len(attr) != 0 {
+			ref.Attrs = append(ref.Attrs, attr)
+		}
+	}
+	return ref, true
+}
+
+// v2ray Domain.Type
+const (
+	domainTypePlain  = 0
+	domainTypeRegex  = 1
+	domainTypeDomain = 2
+	domainTypeFull   = 3
+)
+
+// LoadGeoSite loads the domains of tag in a geosite.dat file. If attrs is not
+// empty, only the domains that have all of the attributes will be loaded.
+func LoadGeoSite(file, tag string, attrs []string) (*domainlist.List, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// message GeoSiteList { repeated GeoSite entry = 1; }
+	// message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+	var domains [][]byte
+	found := false
+	r := &pbReader{b: b}
+	for !r.eof() && !found {
+		field, wireType, v, _, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != wireBytes {
+			continue
+		}
+
+		domains = domains[:0]
+		var code string
+		er := &pbReader{b: v}
+		for !er.eof() {
+			field, wireType, v, _, err := er.next()
+			if err != nil {
+				return nil, err
+			}
+			if wireType != wireBytes {
+				continue
+			}
+			switch field {
+			case 1:
+				code = string(v)
+			case 2:
+				domains = append(domains, v)
+			}
+		}
+		found = strings.EqualFold(code, tag)
+	}
+	if !found {
+		return nil, fmt.Errorf("tag [%s] not found in %s", tag, file)
+	}
+
+	l := domainlist.New()
+	for _, b := range domains {
+		if err := addGeoSiteDomain(l, b, attrs); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// addGeoSiteDomain decodes a v2ray Domain and adds it to l.
+func addGeoSiteDomain(l *domainlist.List, b []byte, attrs []string) error {
+	// message Domain {
+	//   Type type = 1;
+	//   string value = 2;
+	//   repeated Attribute attribute = 3;
+	// }
+	// message Attribute { string key = 1; oneof typed_value { bool bool_value = 2; int64 int_value = 3; } }
+	var domainType uint64
+	var value string
+	var keys []string
+	r := &pbReader{b: b}
+	for !r.eof() {
+		field, wireType, v, n, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireVarint:
+			domainType = n
+		case field == 2 && wireType == wireBytes:
+			value = string(v)
+		case field == 3 && wireType == wireBytes:
+			ar := &pbReader{b: v}
+			for !ar.eof() {
+				field, wireType, v, _, err := ar.next()
+				if err != nil {
+					return err
+				}
+				if field == 1 && wireType == wireBytes {
+					keys = append(keys, string(v))
+				}
+			}
+		}
+	}
+
+	for _, attr := range attrs {
+		if !hasString(keys, attr) {
+			return nil
+		}
+	}
+
+	var t domainlist.MatchType
+	switch domainType {
+	case domainTypePlain:
+		t = domainlist.MatchKeyword
+	case domainTypeRegex:
+		t = domainlist.MatchRegexp
+	case domainTypeDomain:
+		t = domainlist.MatchDomain
+	case domainTypeFull:
+		t = domainlist.MatchFull
+	default:
+		return fmt.Errorf("unknown domain type %d", domainType)
+	}
+	if err := l.AddWithType(t, value); err != nil {
+		return fmt.Errorf("invaild domain [%s], err: [%v]", value, err)
+	}
+	return nil
+}
+
+func hasString(ss []string, s string) bool {
+	for i := range ss {
+		if strings.EqualFold(ss[i], s) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadGeoIP loads the CIDRs of tag in a geoip.dat file.
+func LoadGeoIP(file, tag string) (*ipv6.NetList, error) {
+	nets, err := LoadGeoIPNets(file, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	list := ipv6.NewNetList(make([]ipv6.Net, 0, len(nets)))
+	for _, n := range nets {
+		ip, err := ipv6.Conv(n.IP)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := n.Mask.Size()
+		list.Append(ipv6.NewNet(ip, uint64(ones+128-bits)))
+	}
+	list.Sort()
+	return list, nil
+}
+
+// LoadGeoIPNets is like LoadGeoIP but returns the CIDRs as they are.
+func LoadGeoIPNets(file, tag string) ([]*net.IPNet, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// message GeoIPList { repeated GeoIP entry = 1; }
+	// message GeoIP { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+	// message CIDR { bytes ip = 1; uint32 prefix = 2; }
+	r := &pbReader{b: b}
+	for !r.eof() {
+		field, wireType, v, _, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != wireBytes {
+			continue
+		}
+
+		var code string
+		var cidrs [][]byte
+		var reverse bool
+		er := &pbReader{b: v}
+		for !er.eof() {
+			field, wireType, v, n, err := er.next()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case field == 1 && wireType == wireBytes:
+				code = string(v)
+			case field == 2 && wireType == wireBytes:
+				cidrs = append(cidrs, v)
+			case field == 3 && wireType == wireVarint:
+				reverse = n != 0
+			}
+		}
+		if !strings.EqualFold(code, tag) {
+			continue
+		}
+		if reverse {
+			return nil, errors.New("reverse_match is not supported")
+		}
+
+		nets := make([]*net.IPNet, 0, len(cidrs))
+		for _, c := range cidrs {
+			n, err := decodeGeoIPCIDR(c)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+		return nets, nil
+	}
+	return nil, fmt.Errorf("tag [%s] not found in %s", tag, file)
+}
+
+func decodeGeoIPCIDR(b []byte) (*net.IPNet, error) {
+	var ip net.IP
+	var prefix uint64
+	r := &pbReader{b: b}
+	for !r.eof() {
+		field, wireType, v, n, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			ip = net.IP(v)
+		case field == 2 && wireType == wireVarint:
+			prefix = n
+		}
+	}
+
+	switch len(ip) {
+	case net.IPv4len, net.IPv6len:
+	default:
+		return nil, errors.New("invalid ip length")
+	}
+	bits := len(ip) * 8
+	if prefix > uint64(bits) {
+		return nil, fmt.Errorf("invalid prefix %d of %s", prefix, ip)
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
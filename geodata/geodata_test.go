@@ -0,0 +1,166 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package geodata
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+)
+
+// minimal protobuf encoder for tests
+func uvarint(n uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, n)]
+}
+
+func pbBytes(field int, v []byte) []byte {
+	return join(uvarint(uint64(field<<3|wireBytes)), uvarint(uint64(len(v))), v)
+}
+
+func pbVarint(field int, n uint64) []byte {
+	return join(uvarint(uint64(field<<3|wireVarint)), uvarint(n))
+}
+
+func join(bs ...[]byte) []byte {
+	var b []byte
+	for i := range bs {
+		b = append(b, bs[i]...)
+	}
+	return b
+}
+
+func pbDomain(t uint64, value string, attrs ...string) []byte {
+	b := join(pbVarint(1, t), pbBytes(2, []byte(value)))
+	for _, attr := range attrs {
+		b = append(b, pbBytes(3, join(pbBytes(1, []byte(attr)), pbVarint(2, 1)))...)
+	}
+	return b
+}
+
+func writeTempFile(t *testing.T, b []byte) string {
+	dir, err := ioutil.TempDir("", "geodata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "test.dat")
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func Test_ParseRef(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Ref
+		ok   bool
+	}{
+		{"geosite:cn", Ref{File: "geosite.dat", Tag: "cn"}, true},
+		{"geosite:geolocation-!cn@cn@ads", Ref{File: "geosite.dat", Tag: "geolocation-!cn", Attrs: []string{"cn", "ads"}}, true},
+		{"geoip:/path/to/ip.dat:cn", Ref{File: "/path/to/ip.dat", Tag: "cn"}, true},
+		{"./chn.list", Ref{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseRef(tt.s)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRef(%s) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func Test_LoadGeoSite(t *testing.T) {
+	b := join(
+		pbBytes(1, join(
+			pbBytes(1, []byte("US")),
+			pbBytes(2, pbDomain(domainTypeDomain, "google.com")),
+		)),
+		pbBytes(1, join(
+			pbBytes(1, []byte("CN")),
+			pbBytes(2, pbDomain(domainTypeDomain, "baidu.com", "cn")),
+			pbBytes(2, pbDomain(domainTypeFull, "ad.qq.com", "ads")),
+			pbBytes(2, pbDomain(domainTypePlain, "taobao")),
+			pbBytes(2, pbDomain(domainTypeRegex, `\.cn$`, "cn")),
+		)),
+	)
+	file := writeTempFile(t, b)
+
+	l, err := LoadGeoSite(file, "cn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 4 {
+		t.Fatalf("want 4 domains, got %d", l.Len())
+	}
+	for _, d := range []string{"www.baidu.com", "ad.qq.com", "world.taobao.com", "example.cn"} {
+		if !l.Has(d) {
+			t.Fatalf("%s should be in the list", d)
+		}
+	}
+	if l.Has("www.ad.qq.com") || l.Has("google.com") {
+		t.Fatal("unexpected domain in the list")
+	}
+
+	l, err = LoadGeoSite(file, "CN", []string{"cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 2 || !l.Has("baidu.com") || l.Has("ad.qq.com") {
+		t.Fatal("attribute filter failed")
+	}
+
+	if _, err := LoadGeoSite(file, "jp", nil); err == nil {
+		t.Fatal("unknown tag should fail")
+	}
+}
+
+func Test_LoadGeoIP(t *testing.T) {
+	b := join(
+		pbBytes(1, join(
+			pbBytes(1, []byte("CN")),
+			pbBytes(2, join(pbBytes(1, net.IPv4(1, 0, 1, 0).To4()), pbVarint(2, 24))),
+			pbBytes(2, join(pbBytes(1, net.ParseIP("2001:dd8:1a::")), pbVarint(2, 48))),
+		)),
+	)
+	file := writeTempFile(t, b)
+
+	l, err := LoadGeoIP(file, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 2 {
+		t.Fatalf("want 2 CIDRs, got %d", l.Len())
+	}
+	for _, s := range []string{"1.0.1.1", "2001:dd8:1a::1"} {
+		ip, _ := ipv6.Conv(net.ParseIP(s))
+		if !l.Contains(ip) {
+			t.Fatalf("%s should be in the list", s)
+		}
+	}
+	ip, _ := ipv6.Conv(net.ParseIP("1.0.2.1"))
+	if l.Contains(ip) {
+		t.Fatal("1.0.2.1 should not be in the list")
+	}
+}
@@ -0,0 +1,92 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package geodata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf data")
+
+// pbReader reads fields from a protobuf message.
+type pbReader struct {
+	b []byte
+}
+
+// next reads the next field. For wireVarint fields, v is nil and n is the value.
+// For wireBytes fields, v is the value. Other fields are skipped and both
+// v and n are zero.
+func (r *pbReader) next() (field int, wireType int, v []byte, n uint64, err error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, nil, 0, err
+	}
+	field, wireType = int(key>>3), int(key&7)
+
+	switch wireType {
+	case wireVarint:
+		n, err = r.varint()
+	case wireBytes:
+		var l uint64
+		l, err = r.varint()
+		if err == nil {
+			if l > uint64(len(r.b)) {
+				return 0, 0, nil, 0, errInvalidProtobuf
+			}
+			v, r.b = r.b[:l], r.b[l:]
+		}
+	case wireFixed64:
+		err = r.skip(8)
+	case wireFixed32:
+		err = r.skip(4)
+	default:
+		err = fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+	return field, wireType, v, n, err
+}
+
+func (r *pbReader) varint() (uint64, error) {
+	n, l := binary.Uvarint(r.b)
+	if l <= 0 {
+		return 0, errInvalidProtobuf
+	}
+	r.b = r.b[l:]
+	return n, nil
+}
+
+func (r *pbReader) skip(l int) error {
+	if l > len(r.b) {
+		return errInvalidProtobuf
+	}
+	r.b = r.b[l:]
+	return nil
+}
+
+func (r *pbReader) eof() bool {
+	return len(r.b) == 0
+}
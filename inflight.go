@@ -0,0 +1,97 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// inflightGroup coalesces identical queries. Only one of them will be
+// resolved, others wait for and share its result.
+type inflightGroup struct {
+	sync.Mutex
+	m map[string]*inflightCall
+}
+
+type inflightCall struct {
+	wg   sync.WaitGroup
+	r    *dns.Msg
+	dups int
+}
+
+// do calls fn and returns its result. If there is already a call with the
+// same key in flight, do waits for it and returns its result instead.
+// shared reports whether r was given to multiple callers, in which case
+// r must not be modified.
+func (g *inflightGroup) do(key string, fn func() *dns.Msg) (r *dns.Msg, shared bool) {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*inflightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.Unlock()
+		c.wg.Wait()
+		return c.r, true
+	}
+	c := new(inflightCall)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.Unlock()
+
+	// release waiters even if fn panics, they will get a nil r.
+	defer func() {
+		g.Lock()
+		delete(g.m, key)
+		shared = c.dups > 0
+		g.Unlock()
+		c.wg.Done()
+	}()
+
+	c.r = fn()
+	return c.r, shared
+}
+
+// inflightKey returns the key of q to coalesce identical queries.
+// Queries that have the same question and the same edns options that may
+// affect the result will have the same key.
+// If q can not be coalesced, inflightKey returns an empty string.
+func inflightKey(q *dns.Msg) string {
+	key := cacheKey(q)
+	if len(key) == 0 {
+		return ""
+	}
+
+	if q.CheckingDisabled {
+		key += " cd"
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		if opt.Do() {
+			key += " do"
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key += " ecs " + ecs.Address.String() + "/" + strconv.Itoa(int(ecs.SourceNetmask))
+			}
+		}
+	}
+	return key
+}
@@ -0,0 +1,369 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+)
+
+const defaultListBinaryDir = "./list_bin"
+
+// compiled list file format (big endian):
+//
+//	header:  magic [8]byte | version uint16 | crc32 uint32
+//	body:    kind uint8 | paths | sources | payload
+//	paths:   count uint32 | (len uint16 | path)...
+//	sources: count uint32 | (len uint16 | file | size int64 | mod_time int64 | sha256 [32]byte)...
+//	payload: domain lists: domainlist binary format
+//	         ip lists:     count uint32 | (ip [16]byte | prefix_len uint8)...
+//
+// crc32 is the IEEE checksum of the body. Domain list payloads have their
+// own checksum, so they are not covered by crc32. Paths are the list paths
+// in the config, sources are the files that the list was loaded from.
+const (
+	listBinaryMagic   = "MOSCLIST"
+	listBinaryVersion = 2
+
+	listBinaryHeaderLen = len(listBinaryMagic) + 2 + 4
+)
+
+var (
+	errIncompatibleListBinary = errors.New("incompatible compiled list")
+	errStaleListBinary        = errors.New("the list files were changed after it was compiled")
+)
+
+// the max length of the readable part of compiled file names
+const maxListBinaryNameLen = 64
+
+// listBinaryFile returns the compiled file of the list name in dir. The
+// file name is the hash of name, followed by name with characters other
+// than letters, digits, '.', '-' and '_' removed, e.g. "1a2b...-rules0.domain_list.bin".
+func listBinaryFile(dir, name string) string {
+	h := sha256.Sum256([]byte(name))
+	readable := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return -1
+	}, name)
+	if len(readable) > maxListBinaryNameLen {
+		readable = readable[:maxListBinaryNameLen]
+	}
+	return filepath.Join(dir, hex.EncodeToString(h[:])+"-"+readable+".bin")
+}
+
+// listSource is a file that a list was loaded from.
+type listSource struct {
+	file    string
+	size    int64
+	modTime int64
+	sum     [sha256.Size]byte
+}
+
+// listSources returns the files of paths. Geosite and geoip references
+// are their .dat files.
+func listSources(paths []string) ([]*listSource, error) {
+	files, err := expandListPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	var sources []*listSource
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		f = listFile(f)
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		s := &listSource{file: f}
+		if err := s.stat(); err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+func (s *listSource) stat() error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = stat.Size()
+	s.modTime = stat.ModTime().UnixNano()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	copy(s.sum[:], h.Sum(nil))
+	return nil
+}
+
+// changed reports whether the file of s was changed. The content is
+// compared only if the modification time is different, e.g. the files
+// were copied from the machine that compiled the list.
+func (s *listSource) changed() bool {
+	stat, err := os.Stat(s.file)
+	if err != nil || stat.Size() != s.size {
+		return true
+	}
+	if stat.ModTime().UnixNano() == s.modTime {
+		return false
+	}
+	now := &listSource{file: s.file}
+	return now.stat() != nil || now.sum != s.sum
+}
+
+// writeListBinary compiles a list that was loaded from paths into file.
+// payload writes the list. The file is replaced atomically.
+func writeListBinary(file string, kind listKind, paths []string, payload func(w io.Writer) error) error {
+	sources, err := listSources(paths)
+	if err != nil {
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	body.WriteByte(byte(kind))
+	binary.Write(body, binary.BigEndian, uint32(len(paths)))
+	for _, p := range paths {
+		if err := writeString16(body, p); err != nil {
+			return err
+		}
+	}
+	binary.Write(body, binary.BigEndian, uint32(len(sources)))
+	for _, s := range sources {
+		if err := writeString16(body, s.file); err != nil {
+			return err
+		}
+		binary.Write(body, binary.BigEndian, s.size)
+		binary.Write(body, binary.BigEndian, s.modTime)
+		body.Write(s.sum[:])
+	}
+	payloadOff := body.Len()
+	if err := payload(body); err != nil {
+		return err
+	}
+	checked := body.Bytes()
+	if kind == domainListKind {
+		checked = checked[:payloadOff]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	bw.WriteString(listBinaryMagic)
+	binary.Write(bw, binary.BigEndian, uint16(listBinaryVersion))
+	binary.Write(bw, binary.BigEndian, crc32.ChecksumIEEE(checked))
+	bw.Write(body.Bytes())
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// readListBinary reads a list compiled by writeListBinary from file and
+// calls payload with its payload. It returns errStaleListBinary if paths
+// are different or their files were changed.
+func readListBinary(file string, kind listKind, paths []string, payload func(data []byte) error) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < listBinaryHeaderLen || string(data[:len(listBinaryMagic)]) != listBinaryMagic ||
+		binary.BigEndian.Uint16(data[len(listBinaryMagic):]) != listBinaryVersion {
+		return errIncompatibleListBinary
+	}
+	body := data[listBinaryHeaderLen:]
+
+	r := &bytesReader{b: body}
+	fileKind := listKind(r.next(1)[0])
+	n := r.uint32()
+	if int(n) > len(r.b)/2 {
+		return errTruncatedListBinary
+	}
+	filePaths := make([]string, n)
+	for i := range filePaths {
+		filePaths[i] = r.string16()
+	}
+	n = r.uint32()
+	if int(n) > len(r.b)/(2+8+8+sha256.Size) {
+		return errTruncatedListBinary
+	}
+	sources := make([]*listSource, n)
+	for i := range sources {
+		s := &listSource{file: r.string16()}
+		s.size = int64(r.uint64())
+		s.modTime = int64(r.uint64())
+		copy(s.sum[:], r.next(len(s.sum)))
+		sources[i] = s
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// domain list payloads are checked by domainlist.LoadBinary
+	checked := body
+	if fileKind == domainListKind {
+		checked = body[:len(body)-len(r.b)]
+	}
+	if crc32.ChecksumIEEE(checked) != binary.BigEndian.Uint32(data[len(listBinaryMagic)+2:]) {
+		return errors.New("checksum mismatch")
+	}
+
+	if fileKind != kind {
+		return errIncompatibleListBinary
+	}
+	if len(filePaths) != len(paths) {
+		return errStaleListBinary
+	}
+	for i := range paths {
+		if filePaths[i] != paths[i] {
+			return errStaleListBinary
+		}
+	}
+
+	// glob patterns can match new files
+	files, err := expandListPaths(paths)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		seen[listFile(f)] = struct{}{}
+	}
+	if len(seen) != len(sources) {
+		return errStaleListBinary
+	}
+	for _, s := range sources {
+		if _, ok := seen[s.file]; !ok || s.changed() {
+			return errStaleListBinary
+		}
+	}
+	return payload(r.b)
+}
+
+// writeIPNets writes nets in the ip list payload format.
+func writeIPNets(w io.Writer, nets []*net.IPNet) error {
+	b := make([]byte, 4, 4+len(nets)*17)
+	binary.BigEndian.PutUint32(b, uint32(len(nets)))
+	for _, n := range nets {
+		ones, bits := n.Mask.Size()
+		b = append(b, n.IP.To16()...)
+		b = append(b, byte(ones+128-bits))
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// loadIPNetList loads an ip list payload that was written by writeIPNets.
+func loadIPNetList(data []byte) (*ipv6.NetList, error) {
+	r := &bytesReader{b: data}
+	n := int(r.uint32())
+	if r.err != nil || n > len(r.b)/17 {
+		return nil, errors.New("invalid ip list")
+	}
+	list := ipv6.NewNetList(make([]ipv6.Net, 0, n))
+	for i := 0; i < n; i++ {
+		p := r.next(17)
+		ip, err := ipv6.Conv(net.IP(p[:16]))
+		if err != nil {
+			return nil, err
+		}
+		if p[16] > 128 {
+			return nil, fmt.Errorf("invalid prefix length %d", p[16])
+		}
+		list.Append(ipv6.NewNet(ip, uint64(p[16])))
+	}
+	list.Sort()
+	return list, nil
+}
+
+// writeString16 writes s with its uint16 length.
+func writeString16(b *bytes.Buffer, s string) error {
+	if len(s) > 0xffff {
+		return fmt.Errorf("[%s] is too long", s)
+	}
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+	return nil
+}
+
+// bytesReader reads big endian values from b. After the first error,
+// all reads return zero values.
+type bytesReader struct {
+	b   []byte
+	err error
+}
+
+var errTruncatedListBinary = errors.New("truncated compiled list")
+
+func (r *bytesReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errTruncatedListBinary
+		return make([]byte, n)
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *bytesReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *bytesReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *bytesReader) string16() string {
+	n := binary.BigEndian.Uint16(r.next(2))
+	return string(r.next(int(n)))
+}
@@ -0,0 +1,212 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/Sirupsen/logrus"
+)
+
+func Test_listWatcher_compile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mos-chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domainFile := filepath.Join(dir, "domain.list")
+	ipFile := filepath.Join(dir, "ip.list")
+	if err := ioutil.WriteFile(domainFile, []byte("a.com\n!b.a.com\nkeyword:ads\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ipFile, []byte("1.1.1.0/24\n1.1.1.1\n2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	binDir := filepath.Join(dir, "bin")
+	domainPaths, ipPaths := []string{domainFile}, []string{ipFile}
+
+	w := newListWatcher(entry, nil)
+	w.binDir, w.compile = binDir, true
+	if _, err := w.domainList("rules[0].domain_list", domainPaths); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ipList("local_allowed_ip_list", ipPaths); err != nil {
+		t.Fatal(err)
+	}
+
+	domainBin := listBinaryFile(binDir, "rules[0].domain_list")
+	loadDomains := func(paths []string) (*domainlist.List, error) {
+		var l *domainlist.List
+		err := readListBinary(domainBin, domainListKind, paths, func(data []byte) (err error) {
+			l, err = domainlist.LoadBinary(data)
+			return err
+		})
+		return l, err
+	}
+	l, err := loadDomains(domainPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Has("www.a.com") || l.Has("b.a.com") || !l.Has("myads.org") {
+		t.Fatal("compiled domain list is not the same")
+	}
+	if m := l.Match("b.a.com"); m == nil || m.Source != domainFile || m.Line != 2 {
+		t.Fatalf("unexpected match %v", m)
+	}
+
+	// the domain payload is checked by its own checksum, the rest by
+	// the checksum of the compiled file
+	data, err := ioutil.ReadFile(domainBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptBin := filepath.Join(dir, "corrupt.bin")
+	for i, want := range map[int]string{
+		len(data) - 1:           domainlist.ErrBinaryChecksum.Error(),
+		listBinaryHeaderLen + 8: "checksum mismatch", // in the first path
+	} {
+		b := append([]byte(nil), data...)
+		b[i]++
+		if err := ioutil.WriteFile(corruptBin, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := readListBinary(corruptBin, domainListKind, domainPaths, func(data []byte) error {
+			_, err := domainlist.LoadBinary(data)
+			return err
+		})
+		if err == nil || err.Error() != want {
+			t.Errorf("corrupt byte %d: want %s, got %v", i, want, err)
+		}
+	}
+
+	w = newListWatcher(entry, nil)
+	w.binDir = binDir
+	il, err := w.ipList("local_allowed_ip_list", ipPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[string]bool{"1.1.1.1": true, "1.1.2.1": false, "2001:db8::1": true} {
+		ip, _ := ipv6.Conv(net.ParseIP(s))
+		if il.Contains(ip) != want {
+			t.Errorf("Contains(%s) should be %v", s, want)
+		}
+	}
+	if il.Len() != 2 {
+		t.Errorf("covered cidrs should be removed, length %d", il.Len())
+	}
+
+	// the same content with another modification time, e.g. copied
+	// from another machine
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(domainFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDomains(domainPaths); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadDomains([]string{domainFile, ipFile}); err != errStaleListBinary {
+		t.Fatalf("changed paths should be stale, %v", err)
+	}
+	err = readListBinary(domainBin, ipListKind, domainPaths, func([]byte) error { return nil })
+	if err != errIncompatibleListBinary {
+		t.Fatalf("want errIncompatibleListBinary, got %v", err)
+	}
+	if err := ioutil.WriteFile(domainFile, []byte("a.com\nc.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDomains(domainPaths); err != errStaleListBinary {
+		t.Fatalf("changed files should be stale, %v", err)
+	}
+
+	// stale lists are loaded from their files
+	dl, err := w.domainList("rules[0].domain_list", domainPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dl.Has("c.com.") {
+		t.Fatal("stale compiled list should not be used")
+	}
+}
+
+func Test_initDispather_compile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mos-chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domainFile := filepath.Join(dir, "domain.list")
+	if err := ioutil.WriteFile(domainFile, []byte("a.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		BindAddr:              "127.0.0.1:0",
+		RemoteServer:          "127.0.0.1:53",
+		LocalForcedDomainList: StringList{domainFile},
+		ListBinaryDir:         filepath.Join(dir, "bin"),
+		CacheSize:             16,
+		CacheDumpFile:         filepath.Join(dir, "cache.dump"),
+		RouteMemorySize:       16,
+		RouteMemoryFile:       filepath.Join(dir, "route_memory"),
+		DHCPLeasesFile:        filepath.Join(dir, "not_exist.leases"),
+		compileLists:          true,
+	}
+	d, err := initDispather(&c, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.cache != nil || d.memCache != nil || d.routeMemory != nil || d.dhcpLeases != nil {
+		t.Fatal("only lists should be loaded in compile mode")
+	}
+	if _, err := os.Stat(listBinaryFile(c.ListBinaryDir, "local_forced_domain_list")); err != nil {
+		t.Fatalf("list is not compiled, %v", err)
+	}
+}
+
+func Test_listBinaryFile(t *testing.T) {
+	names := []string{
+		"rules[0].domain_list",
+		"rules[0]:domain_list",
+		"a/b\\c:d?e*f",
+		"g|h<i>j\"k",
+		strings.Repeat("x", 1000),
+		strings.Repeat("x", 1001),
+	}
+	seen := make(map[string]string)
+	for _, name := range names {
+		file := filepath.Base(listBinaryFile("bin", name))
+		if strings.ContainsAny(file, "/\\:?*|<>\"[]") || len(file) > 255 {
+			t.Errorf("invalid file name %s of %s", file, name)
+		}
+		if other, ok := seen[file]; ok {
+			t.Errorf("%s and %s have the same file name %s", name, other, file)
+		}
+		seen[file] = name
+	}
+}
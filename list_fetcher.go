@@ -0,0 +1,320 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultListCacheDir       = "./list_cache"
+	defaultListUpdateInterval = time.Hour * 24
+	defaultListMinEntries     = 1
+
+	listDownloadTimeout = time.Second * 30
+	maxListSize         = 64 << 20
+)
+
+type listKind int
+
+const (
+	domainListKind listKind = iota
+	ipListKind
+)
+
+// listFetcher downloads lists from http(s) urls. Downloaded lists are
+// saved in a cache dir, list watchers load them from there. A list is
+// updated periodically, the new copy replaces the cached one only if it
+// passes validation, so a list watcher will reload it.
+type listFetcher struct {
+	dir        string
+	interval   time.Duration
+	minEntries int
+	client     *http.Client
+	entry      *logrus.Entry
+
+	lists map[remoteListKey]*remoteList
+}
+
+// remoteListKey identifies a remote list. The same url used as different
+// kinds or formats are different lists, they are validated differently.
+type remoteListKey struct {
+	url    string
+	kind   listKind
+	format domainlist.Format
+}
+
+// remoteList is a list that is downloaded from url.
+type remoteList struct {
+	url    string
+	kind   listKind
+	format domainlist.Format
+	file   string // the cached copy
+	meta   remoteListMeta
+}
+
+// remoteListMeta is saved with the cached copy for conditional requests.
+type remoteListMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+func newListFetcher(dir string, interval time.Duration, minEntries int, entry *logrus.Entry) *listFetcher {
+	if len(dir) == 0 {
+		dir = defaultListCacheDir
+	}
+	if interval <= 0 {
+		interval = defaultListUpdateInterval
+	}
+	if minEntries <= 0 {
+		minEntries = defaultListMinEntries
+	}
+	return &listFetcher{
+		dir:        dir,
+		interval:   interval,
+		minEntries: minEntries,
+		client:     &http.Client{Timeout: listDownloadTimeout},
+		entry:      entry,
+		lists:      make(map[remoteListKey]*remoteList),
+	}
+}
+
+// isListURL reports whether p is a http(s) url.
+func isListURL(p string) bool {
+	return strings.HasPrefix(p, "https://") || strings.HasPrefix(p, "http://")
+}
+
+// resolve replaces urls in paths with their cached copies. A url is
+// downloaded if it has no cached copy yet.
+func (f *listFetcher) resolve(paths []string, kind listKind) ([]string, error) {
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		format, u := splitListFormat(p)
+		if !isListURL(u) {
+			resolved = append(resolved, p)
+			continue
+		}
+		if f == nil {
+			return nil, fmt.Errorf("can not download %s", u)
+		}
+
+		key := remoteListKey{url: u, kind: kind, format: format}
+		rl, ok := f.lists[key]
+		if !ok {
+			rl = &remoteList{url: u, kind: kind, format: format, file: filepath.Join(f.dir, listCacheName(key))}
+			if _, err := os.Stat(rl.file); err == nil {
+				if err := rl.loadMeta(); err != nil {
+					// the next update will be a full download
+					f.entry.Warnf("listFetcher: ignored the broken meta of %s, %v", u, err)
+					rl.meta = remoteListMeta{}
+				}
+				f.entry.Infof("listFetcher: use the cached copy of %s, it will be updated in background", u)
+			} else if err := f.fetch(rl); err != nil {
+				return nil, fmt.Errorf("failed to download %s, %w", u, err)
+			}
+			f.lists[key] = rl
+		}
+		if format != domainlist.FormatAuto {
+			resolved = append(resolved, format.String()+":"+rl.file)
+		} else {
+			resolved = append(resolved, rl.file)
+		}
+	}
+	return resolved, nil
+}
+
+// listCacheName returns the file name of the cached copy of a list.
+func listCacheName(key remoteListKey) string {
+	url := key.url
+	h := sha1.Sum([]byte(fmt.Sprintf("%d:%s:%s", key.kind, key.format, url)))
+	name := url[strings.LastIndexByte(url, '/')+1:]
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return hex.EncodeToString(h[:8]) + "-" + name
+}
+
+func (rl *remoteList) metaFile() string {
+	return rl.file + ".meta"
+}
+
+// loadMeta loads the meta of the cached copy. A missing meta is not
+// an error.
+func (rl *remoteList) loadMeta() error {
+	b, err := ioutil.ReadFile(rl.metaFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, &rl.meta)
+}
+
+func (rl *remoteList) saveMeta() error {
+	rl.meta.URL = rl.url
+	b, err := json.MarshalIndent(&rl.meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rl.metaFile(), b, 0644)
+}
+
+// fetch downloads rl. The cached copy is replaced if the new copy
+// is valid. It is not an error if rl was not modified.
+func (f *listFetcher) fetch(rl *remoteList) error {
+	req, err := http.NewRequest(http.MethodGet, rl.url, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(rl.file); err == nil {
+		if len(rl.meta.ETag) != 0 {
+			req.Header.Set("If-None-Match", rl.meta.ETag)
+		}
+		if len(rl.meta.LastModified) != 0 {
+			req.Header.Set("If-Modified-Since", rl.meta.LastModified)
+		}
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		f.entry.Debugf("listFetcher: %s not modified", rl.url)
+		return nil
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.dir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if it was renamed
+	n, err := io.Copy(tmp, io.LimitReader(body, maxListSize+1))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if n > maxListSize {
+		return fmt.Errorf("list is larger than %d bytes", maxListSize)
+	}
+
+	entries, err := f.validate(rl, tmp.Name())
+	if err != nil {
+		return fmt.Errorf("invalid list, %w", err)
+	}
+	if err := os.Rename(tmp.Name(), rl.file); err != nil {
+		return err
+	}
+
+	rl.meta.ETag = resp.Header.Get("ETag")
+	rl.meta.LastModified = resp.Header.Get("Last-Modified")
+	if err := rl.saveMeta(); err != nil {
+		f.entry.Warnf("listFetcher: failed to save meta of %s, %v", rl.url, err)
+	}
+	f.entry.Infof("listFetcher: %s downloaded, %d entries", rl.url, entries)
+	return nil
+}
+
+// validate loads file as rl and checks its length.
+func (f *listFetcher) validate(rl *remoteList, file string) (int, error) {
+	var n int
+	switch rl.kind {
+	case domainListKind:
+		if rl.format != domainlist.FormatAuto {
+			file = rl.format.String() + ":" + file
+		}
+		l, err := loadDomainList(file, f.entry)
+		if err != nil {
+			return 0, err
+		}
+		n = l.Len()
+	case ipListKind:
+		nets, err := loadIPNets(file)
+		if err != nil {
+			return 0, err
+		}
+		n = len(nets)
+	default:
+		return 0, errors.New("unknown list kind")
+	}
+	return n, checkListLen(n, f.minEntries)
+}
+
+// checkListLen checks whether a list with n entries has at least
+// minEntries entries.
+func checkListLen(n, minEntries int) error {
+	if n < minEntries {
+		return fmt.Errorf("%d entries, at least %d entries are required", n, minEntries)
+	}
+	return nil
+}
+
+// run updates lists periodically. Lists that use a cached copy at
+// startup are updated immediately.
+func (f *listFetcher) run() {
+	if f == nil || len(f.lists) == 0 {
+		return
+	}
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		for _, rl := range f.lists {
+			if err := f.fetch(rl); err != nil {
+				f.entry.Warnf("listFetcher: failed to update %s, the cached copy is kept, %v", rl.url, err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,155 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/Sirupsen/logrus"
+)
+
+func Test_listFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mos-chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	content, etag := "a.com\nb.com\n", `"v1"`
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			gw.Write([]byte(content))
+			gw.Close()
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	url := server.URL + "/list.txt"
+	setContent := func(c, e string) {
+		mu.Lock()
+		content, etag = c, e
+		mu.Unlock()
+	}
+
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	f := newListFetcher(dir, time.Hour, 2, entry)
+	w := newListWatcher(entry, f)
+	dl, err := w.domainList("test", []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dl.Has("a.com.") || !dl.Has("b.com.") {
+		t.Fatal("list should be downloaded")
+	}
+	rl := f.lists[remoteListKey{url: url, kind: domainListKind}]
+
+	// not modified
+	if err := f.fetch(rl); err != nil {
+		t.Fatal(err)
+	}
+	if notModified != 1 {
+		t.Fatal("conditional request should be sent")
+	}
+
+	// too few entries
+	setContent("c.com\n", `"v2"`)
+	if err := f.fetch(rl); err == nil {
+		t.Fatal("list with too few entries should be rejected")
+	}
+	w.check()
+	if !dl.Has("a.com.") {
+		t.Fatal("the cached copy should be kept")
+	}
+
+	// updated
+	setContent("c.com\nd.com\n", `"v3"`)
+	if err := f.fetch(rl); err != nil {
+		t.Fatal(err)
+	}
+	w.check()
+	if dl.Has("a.com.") || !dl.Has("c.com.") {
+		t.Fatal("list should be updated")
+	}
+
+	// the same url in another format is another list
+	plain, err := w.domainList("plain", []string{"plain:" + url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKey := remoteListKey{url: url, kind: domainListKind, format: domainlist.FormatPlain}
+	if !plain.Has("d.com.") || f.lists[plainKey] == nil || f.lists[plainKey].file == rl.file {
+		t.Fatal("the plain list should have its own cached copy")
+	}
+
+	// offline start with the cached copy
+	server.Close()
+	f2 := newListFetcher(dir, time.Hour, 2, entry)
+	w2 := newListWatcher(entry, f2)
+	dl, err = w2.domainList("test", []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dl.Has("d.com.") {
+		t.Fatal("the cached copy should be used")
+	}
+	if f2.lists[remoteListKey{url: url, kind: domainListKind}].meta.ETag != `"v3"` {
+		t.Fatal("meta should be loaded")
+	}
+
+	// offline start with a broken meta
+	if err := ioutil.WriteFile(rl.metaFile(), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dl, err = newListWatcher(entry, newListFetcher(dir, time.Hour, 2, entry)).domainList("test", []string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dl.Has("d.com.") {
+		t.Fatal("the cached copy should be used if its meta is broken")
+	}
+
+	// no cached copy
+	if _, err := w2.domainList("test", []string{server.URL + "/none.txt"}); err == nil {
+		t.Fatal("list without a cached copy should fail")
+	}
+	if _, err := newListWatcher(entry, nil).domainList("test", []string{url}); err == nil {
+		t.Fatal("url should fail without fetcher")
+	}
+}
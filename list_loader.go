@@ -0,0 +1,277 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/geodata"
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// the max number of invalid lines that are logged for each file
+	maxLoggedInvalidLines = 10
+
+	// a file is broken if more than this ratio of its lines are invalid,
+	// e.g. it was truncated or is an html error page.
+	maxInvalidLineRatio = 0.5
+)
+
+// loadDomainList loads a domain list from s. s can be a file path, a file
+// path with a format prefix like "dnsmasq:/path/to/list" or a geosite
+// reference like "geosite:cn". Invalid lines are logged and skipped. If
+// the file has invalid lines but no valid entries, or too many invalid
+// lines, it is considered broken and an error is returned.
+func loadDomainList(s string, entry *logrus.Entry) (*domainlist.List, error) {
+	if strings.HasPrefix(s, geodata.GeoSitePrefix) {
+		ref, _ := geodata.ParseRef(s)
+		return geodata.LoadGeoSite(ref.File, ref.Tag, ref.Attrs)
+	}
+
+	format, file := splitListFormat(s)
+	l, report, err := domainlist.LoadFile(file, format)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range report.Invalid {
+		if i == maxLoggedInvalidLines {
+			entry.Warnf("loadDomainList: %s: %d more invalid lines skipped", file, len(report.Invalid)-i)
+			break
+		}
+		entry.Warnf("loadDomainList: %s: invalid %v, skipped", file, e)
+	}
+	if invalid := len(report.Invalid); invalid != 0 {
+		total := invalid + l.Len() + report.Ignored
+		if l.Len() == 0 || float64(invalid) > float64(total)*maxInvalidLineRatio {
+			return nil, fmt.Errorf("%d of %d lines are invalid, the file may be broken", invalid, total)
+		}
+	}
+	if report.Ignored != 0 {
+		entry.Debugf("loadDomainList: %s: %d unsupported %s rules ignored", file, report.Ignored, report.Format)
+	}
+	if format == domainlist.FormatAuto {
+		entry.Debugf("loadDomainList: %s: format %s detected", file, report.Format)
+	}
+	return l, nil
+}
+
+// splitListFormat splits a path like "dnsmasq:/path/to/list" into its
+// format and file. The format is FormatAuto if p has no format prefix.
+func splitListFormat(p string) (domainlist.Format, string) {
+	if i := strings.IndexByte(p, ':'); i > 0 {
+		if f, ok := domainlist.ParseFormat(p[:i]); ok {
+			return f, p[i+1:]
+		}
+	}
+	return domainlist.FormatAuto, p
+}
+
+// loadDomainLists loads and merges domain lists from files, glob patterns
+// and geosite references. Duplicate and covered entries are removed.
+func loadDomainLists(paths []string, entry *logrus.Entry) (*domainlist.List, error) {
+	files, err := expandListPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := domainlist.New()
+	for _, f := range files {
+		l, err := loadDomainList(f, entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		entry.Infof("loadDomainLists: %d entries loaded from %s", l.Len(), f)
+		merged.Merge(l)
+	}
+	if n := merged.Compact(); n != 0 {
+		entry.Infof("loadDomainLists: %d duplicate or covered entries removed", n)
+	}
+	return merged, nil
+}
+
+// loadIPLists loads and merges ip lists from files, glob patterns
+// and geoip references. Duplicate and covered CIDRs are removed.
+func loadIPLists(paths []string, entry *logrus.Entry) (*ipv6.NetList, error) {
+	nets, err := loadMergedIPNets(paths, entry)
+	if err != nil {
+		return nil, err
+	}
+	return newNetList(nets)
+}
+
+// loadMergedIPNets is like loadIPLists, but returns the merged CIDRs.
+func loadMergedIPNets(paths []string, entry *logrus.Entry) ([]*net.IPNet, error) {
+	files, err := expandListPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []*net.IPNet
+	for _, f := range files {
+		nets, err := loadIPNets(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		entry.Infof("loadIPLists: %d entries loaded from %s", len(nets), f)
+		merged = append(merged, nets...)
+	}
+	compacted := compactIPNets(merged)
+	if n := len(merged) - len(compacted); n != 0 {
+		entry.Infof("loadIPLists: %d duplicate or covered entries removed", n)
+	}
+	return compacted, nil
+}
+
+// expandListPaths expands glob patterns in paths. References like
+// "geosite:cn" are kept as they are. Format prefixes are kept.
+func expandListPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		if strings.HasPrefix(p, geodata.GeoSitePrefix) || strings.HasPrefix(p, geodata.GeoIPPrefix) || !strings.ContainsAny(p, "*?[") {
+			files = append(files, p)
+			continue
+		}
+		format, pattern := splitListFormat(p)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern [%s], %w", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file matches [%s]", p)
+		}
+		for _, m := range matches {
+			if format != domainlist.FormatAuto {
+				m = format.String() + ":" + m
+			}
+			files = append(files, m)
+		}
+	}
+	return files, nil
+}
+
+// loadIPNets loads CIDRs from s. s can be a file path or a geoip reference.
+func loadIPNets(s string) ([]*net.IPNet, error) {
+	if strings.HasPrefix(s, geodata.GeoIPPrefix) {
+		ref, _ := geodata.ParseRef(s)
+		if len(ref.Attrs) != 0 {
+			return nil, fmt.Errorf("geoip reference [%s] can not have attributes", s)
+		}
+		return geodata.LoadGeoIPNets(ref.File, ref.Tag)
+	}
+
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nets []*net.IPNet
+	sc := bufio.NewScanner(f)
+	lineCounter := 0
+	for sc.Scan() {
+		lineCounter++
+		line := strings.TrimSpace(sc.Text())
+
+		//ignore lines begin with # and empty lines
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		n, err := parseIPNet(line)
+		if err != nil {
+			return nil, fmt.Errorf("invaild CIDR format in line %d", lineCounter)
+		}
+		nets = append(nets, n)
+	}
+	return nets, sc.Err()
+}
+
+// parseIPNet parses a CIDR or a single IP. IPv4 addresses are in 4-byte form.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip [%s]", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// compactIPNets removes duplicate CIDRs and CIDRs that are covered by
+// another one. IPv4 CIDRs are treated as IPv4-mapped IPv6 CIDRs.
+func compactIPNets(nets []*net.IPNet) []*net.IPNet {
+	type cidr struct {
+		ip   net.IP // 16-byte form
+		ones int    // ipv6 prefix length
+		n    *net.IPNet
+	}
+	cidrs := make([]cidr, 0, len(nets))
+	for _, n := range nets {
+		ones, bits := n.Mask.Size()
+		cidrs = append(cidrs, cidr{ip: n.IP.Mask(n.Mask).To16(), ones: ones + 128 - bits, n: n})
+	}
+	sort.Slice(cidrs, func(i, j int) bool {
+		if c := bytes.Compare(cidrs[i].ip, cidrs[j].ip); c != 0 {
+			return c < 0
+		}
+		return cidrs[i].ones < cidrs[j].ones
+	})
+
+	// CIDRs are either nested or disjoint. After sorting, a CIDR can
+	// only be covered by the last kept one.
+	out := make([]*net.IPNet, 0, len(cidrs))
+	var last *cidr
+	for i := range cidrs {
+		c := &cidrs[i]
+		if last != nil && last.ones <= c.ones && c.ip.Mask(net.CIDRMask(last.ones, 128)).Equal(last.ip) {
+			continue
+		}
+		out = append(out, c.n)
+		last = c
+	}
+	return out
+}
+
+func newNetList(nets []*net.IPNet) (*ipv6.NetList, error) {
+	list := ipv6.NewNetList(make([]ipv6.Net, 0, len(nets)))
+	for _, n := range nets {
+		ip, err := ipv6.Conv(n.IP)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := n.Mask.Size()
+		list.Append(ipv6.NewNet(ip, uint64(ones+128-bits)))
+	}
+	list.Sort()
+	return list, nil
+}
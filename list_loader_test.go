@@ -0,0 +1,114 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/Sirupsen/logrus"
+)
+
+func Test_loadLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"a.ip":     "1.0.0.0/8\n1.2.3.0/24\n2001:db8::/32\n",
+		"b.ip":     "1.0.0.0/8\n2.2.2.2\n2001:db8:1::/48\n",
+		"a.domain": "google.com\nwww.google.com\n",
+		"b.domain": "mail.google.com\nfull:google.com\nexample.com\n",
+		"c.conf":   "server=/baidu.com/114.114.114.114\nserver=/qq.com/114.114.114.114\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := logrus.NewEntry(logrus.StandardLogger())
+
+	ipList, err := loadIPLists([]string{filepath.Join(dir, "*.ip")}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipList.Len() != 3 {
+		t.Fatalf("want 3 CIDRs, got %d", ipList.Len())
+	}
+	for s, want := range map[string]bool{
+		"1.2.3.4":       true,
+		"1.200.0.1":     true,
+		"2.2.2.2":       true,
+		"2.2.2.3":       false,
+		"2001:db8:1::1": true,
+		"2001:db9::1":   false,
+	} {
+		ip, _ := ipv6.Conv(net.ParseIP(s))
+		if ipList.Contains(ip) != want {
+			t.Fatalf("Contains(%s) should be %v", s, want)
+		}
+	}
+
+	domainList, err := loadDomainLists([]string{filepath.Join(dir, "a.domain"), filepath.Join(dir, "b.domain")}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domainList.Len() != 2 || !domainList.Has("mail.google.com") || !domainList.Has("example.com") {
+		t.Fatal("invalid merged domain list")
+	}
+
+	// the format prefix is kept after the pattern is expanded
+	domainList, err = loadDomainLists([]string{"dnsmasq:" + filepath.Join(dir, "*.conf")}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domainList.Len() != 2 || !domainList.Has("www.baidu.com") || !domainList.Has("qq.com") {
+		t.Fatal("invalid dnsmasq domain list")
+	}
+
+	// broken files
+	for name, content := range map[string]string{
+		"garbage.domain":   "<html>\n<body>\n</body>\n</html>\n",
+		"truncated.domain": "google.com\n<html>\n<body>\n</body>\n",
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDomainLists([]string{file}, entry); err == nil {
+			t.Fatalf("%s should fail to load", name)
+		}
+	}
+	// a few invalid lines are skipped
+	file := filepath.Join(dir, "invalid_line.domain")
+	if err := ioutil.WriteFile(file, []byte("google.com\nexample.com\nregexp:(\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if domainList, err = loadDomainLists([]string{file}, entry); err != nil || domainList.Len() != 2 {
+		t.Fatalf("invalid lines should be skipped, %v", err)
+	}
+
+	if _, err := loadIPLists([]string{filepath.Join(dir, "*.none")}, entry); err == nil {
+		t.Fatal("pattern matches no file should fail")
+	}
+}
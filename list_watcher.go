@@ -0,0 +1,385 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/geodata"
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// how often list files are checked if inotify is not available
+	listPollInterval = time.Second * 10
+
+	// how long to wait after a file event before reloading, so that
+	// writers can finish their work.
+	listReloadDelay = time.Second
+)
+
+// domainList is a domain list loaded from files. It is replaced as a
+// whole when its files are reloaded.
+type domainList struct {
+	v atomic.Value // *domainlist.List
+}
+
+func newDomainList(l *domainlist.List) *domainList {
+	dl := new(domainList)
+	dl.store(l)
+	return dl
+}
+
+func (l *domainList) load() *domainlist.List {
+	return l.v.Load().(*domainlist.List)
+}
+
+func (l *domainList) store(list *domainlist.List) {
+	list.Build()
+	l.v.Store(list)
+}
+
+func (l *domainList) Has(fqdn string) bool {
+	return l.load().Has(fqdn)
+}
+
+func (l *domainList) Match(fqdn string) *domainlist.Match {
+	return l.load().Match(fqdn)
+}
+
+func (l *domainList) Len() int {
+	return l.load().Len()
+}
+
+// ipList is an ip list loaded from files. It is replaced as a whole
+// when its files are reloaded.
+type ipList struct {
+	v atomic.Value // *ipv6.NetList
+}
+
+func newIPList(l *ipv6.NetList) *ipList {
+	il := new(ipList)
+	il.v.Store(l)
+	return il
+}
+
+func (l *ipList) load() *ipv6.NetList {
+	return l.v.Load().(*ipv6.NetList)
+}
+
+func (l *ipList) Contains(ip ipv6.IPv6) bool {
+	return l.load().Contains(ip)
+}
+
+func (l *ipList) Len() int {
+	return l.load().Len()
+}
+
+// listWatcher reloads domain and ip lists when their files are changed.
+// Files are watched by inotify if it is available, otherwise they are
+// polled. If a list fails to reload, the old one is kept.
+type listWatcher struct {
+	entry   *logrus.Entry
+	fetcher *listFetcher // can be nil
+	lists   []*watchedList
+
+	// minEntries is the min length of reloaded lists, so an emptied or
+	// broken file won't wipe a list. It's the same as the fetcher's.
+	minEntries int
+
+	// binDir is the dir of compiled lists. Lists are loaded from their
+	// compiled files if they are up to date. Empty means disabled.
+	binDir string
+	// compile makes lists always load from their files and be compiled
+	// into binDir.
+	compile bool
+}
+
+type watchedList struct {
+	name   string
+	paths  []string
+	stamp  string // stamp of files when the list was loaded
+	reload func() (int, error)
+}
+
+// newListWatcher creates a list watcher. If fetcher is nil, urls are
+// not allowed in list paths.
+func newListWatcher(entry *logrus.Entry, fetcher *listFetcher) *listWatcher {
+	w := &listWatcher{entry: entry, fetcher: fetcher, minEntries: defaultListMinEntries}
+	if fetcher != nil {
+		w.minEntries = fetcher.minEntries
+	}
+	return w
+}
+
+// domainList loads a domain list from paths and watches its files.
+func (w *listWatcher) domainList(name string, paths []string) (*domainList, error) {
+	paths, err := w.fetcher.resolve(paths, domainListKind)
+	if err != nil {
+		return nil, err
+	}
+	stamp := listStamp(paths)
+	l, err := w.loadDomainLists(name, paths)
+	if err != nil {
+		return nil, err
+	}
+	dl := newDomainList(l)
+	w.lists = append(w.lists, &watchedList{name: name, paths: paths, stamp: stamp, reload: func() (int, error) {
+		l, err := loadDomainLists(paths, w.entry)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkListLen(l.Len(), w.minEntries); err != nil {
+			return 0, err
+		}
+		dl.store(l)
+		return l.Len(), nil
+	}})
+	return dl, nil
+}
+
+// ipList loads an ip list from paths and watches its files.
+func (w *listWatcher) ipList(name string, paths []string) (*ipList, error) {
+	paths, err := w.fetcher.resolve(paths, ipListKind)
+	if err != nil {
+		return nil, err
+	}
+	stamp := listStamp(paths)
+	l, err := w.loadIPLists(name, paths)
+	if err != nil {
+		return nil, err
+	}
+	il := newIPList(l)
+	w.lists = append(w.lists, &watchedList{name: name, paths: paths, stamp: stamp, reload: func() (int, error) {
+		l, err := loadIPLists(paths, w.entry)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkListLen(l.Len(), w.minEntries); err != nil {
+			return 0, err
+		}
+		il.v.Store(l)
+		return l.Len(), nil
+	}})
+	return il, nil
+}
+
+// loadDomainLists loads the domain list name from its compiled file if
+// it is up to date, otherwise from paths. In compile mode, the list is
+// loaded from paths and compiled.
+func (w *listWatcher) loadDomainLists(name string, paths []string) (*domainlist.List, error) {
+	file := w.binaryFile(name)
+	if len(file) != 0 && !w.compile {
+		var l *domainlist.List
+		err := readListBinary(file, domainListKind, paths, func(data []byte) (err error) {
+			l, err = domainlist.LoadBinary(data)
+			return err
+		})
+		if err == nil {
+			w.entry.Infof("listWatcher: %s loaded from compiled %s, length %d", name, file, l.Len())
+			return l, nil
+		}
+		w.binaryNotUsed(name, file, err)
+	}
+
+	l, err := loadDomainLists(paths, w.entry)
+	if err != nil {
+		return nil, err
+	}
+	if w.compile {
+		if err := writeListBinary(file, domainListKind, paths, l.WriteBinary); err != nil {
+			return nil, fmt.Errorf("failed to compile %s, %w", name, err)
+		}
+		w.entry.Infof("listWatcher: %s compiled to %s", name, file)
+	}
+	return l, nil
+}
+
+// loadIPLists is like loadDomainLists, but loads an ip list.
+func (w *listWatcher) loadIPLists(name string, paths []string) (*ipv6.NetList, error) {
+	file := w.binaryFile(name)
+	if len(file) != 0 && !w.compile {
+		var l *ipv6.NetList
+		err := readListBinary(file, ipListKind, paths, func(data []byte) (err error) {
+			l, err = loadIPNetList(data)
+			return err
+		})
+		if err == nil {
+			w.entry.Infof("listWatcher: %s loaded from compiled %s, length %d", name, file, l.Len())
+			return l, nil
+		}
+		w.binaryNotUsed(name, file, err)
+	}
+
+	nets, err := loadMergedIPNets(paths, w.entry)
+	if err != nil {
+		return nil, err
+	}
+	if w.compile {
+		err := writeListBinary(file, ipListKind, paths, func(wr io.Writer) error {
+			return writeIPNets(wr, nets)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %s, %w", name, err)
+		}
+		w.entry.Infof("listWatcher: %s compiled to %s", name, file)
+	}
+	return newNetList(nets)
+}
+
+// binaryFile returns the compiled file of the list name, or an empty
+// string if compiled lists are disabled.
+func (w *listWatcher) binaryFile(name string) string {
+	if len(w.binDir) == 0 {
+		return ""
+	}
+	return listBinaryFile(w.binDir, name)
+}
+
+// binaryNotUsed logs why the compiled file of a list was not used.
+func (w *listWatcher) binaryNotUsed(name, file string, err error) {
+	switch {
+	case os.IsNotExist(err):
+		w.entry.Debugf("listWatcher: %s has no compiled file %s", name, file)
+	case err == errStaleListBinary:
+		w.entry.Warnf("listWatcher: compiled %s is outdated, %s is loaded from its files, run with -compile to update it", file, name)
+	default:
+		w.entry.Warnf("listWatcher: failed to load compiled %s, %s is loaded from its files, %v", file, name, err)
+	}
+}
+
+// check reloads lists whose files were changed.
+func (w *listWatcher) check() {
+	for _, l := range w.lists {
+		stamp := listStamp(l.paths)
+		if stamp == l.stamp {
+			continue
+		}
+		// a broken file won't be reloaded again until it is changed
+		l.stamp = stamp
+		n, err := l.reload()
+		if err != nil {
+			w.entry.Warnf("listWatcher: failed to reload %s, the old list is kept, %v", l.name, err)
+			continue
+		}
+		w.entry.Infof("listWatcher: %s reloaded, length %d", l.name, n)
+	}
+}
+
+// run watches files of lists and updates lists from urls. It never
+// returns if there are lists.
+func (w *listWatcher) run() {
+	if len(w.lists) == 0 {
+		return
+	}
+	go w.fetcher.run()
+
+	var poll <-chan time.Time
+	startPolling := func(err error) {
+		w.entry.Warnf("listWatcher: inotify is not available, poll list files every %s, %v", listPollInterval, err)
+		poll = time.NewTicker(listPollInterval).C
+	}
+	events, err := watchDirs(w.dirs())
+	if err != nil {
+		startPolling(err)
+	}
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				startPolling(fmt.Errorf("inotify stopped"))
+				continue
+			}
+			if delay == nil {
+				delay = time.After(listReloadDelay)
+			}
+		case <-delay:
+			delay = nil
+			w.check()
+		case <-poll:
+			w.check()
+		}
+	}
+}
+
+// dirs returns the directories that contain files of lists. Directories
+// are watched instead of files, so files that are replaced by rename
+// and new files that match glob patterns are noticed. For symlinks, the
+// directories of their targets are also watched.
+func (w *listWatcher) dirs() []string {
+	var dirs []string
+	seen := make(map[string]struct{})
+	add := func(dir string) {
+		if _, ok := seen[dir]; ok {
+			return
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	for _, l := range w.lists {
+		for _, p := range l.paths {
+			file := listFile(p)
+			add(filepath.Dir(file))
+			if target, err := filepath.EvalSymlinks(file); err == nil {
+				add(filepath.Dir(target))
+			}
+		}
+	}
+	return dirs
+}
+
+// listFile returns the file of a list path. For geosite and geoip
+// references it is the .dat file.
+func listFile(p string) string {
+	if ref, ok := geodata.ParseRef(p); ok {
+		return ref.File
+	}
+	_, file := splitListFormat(p)
+	return file
+}
+
+// listStamp returns a string that changes if a file of paths was changed,
+// created or removed.
+func listStamp(paths []string) string {
+	files, err := expandListPaths(paths)
+	if err != nil {
+		return err.Error()
+	}
+	var b strings.Builder
+	for _, f := range files {
+		f = listFile(f)
+		stat, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:-;", f)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f, stat.Size(), stat.ModTime().UnixNano())
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchDirs watches dirs by inotify. A value is sent to the returned
+// channel when a file in dirs was created, written, moved or removed.
+// Parents of dirs are also watched, so a dir that was removed or replaced,
+// e.g. by "mv new_dir dir", is watched again when it appears. The channel
+// is closed if an error occurs.
+func watchDirs(dirs []string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{fd: fd, dirs: make(map[int32]string), children: make(map[int32]map[string]string)}
+	for _, dir := range dirs {
+		if err := w.watchDir(dir); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("failed to watch %s, %w", dir, err)
+		}
+		w.watchParent(dir)
+	}
+
+	c := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		defer syscall.Close(fd)
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			changed := false
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				nameOff := off + syscall.SizeofInotifyEvent
+				off = nameOff + int(e.Len)
+				if off > n {
+					break
+				}
+				name := strings.TrimRight(string(buf[nameOff:off]), "\x00")
+				if w.handle(e.Wd, e.Mask, name) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return c, nil
+}
+
+// inotify events of watched dirs and their parents
+const (
+	inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+		syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	inotifyParentMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+)
+
+type inotifyWatcher struct {
+	fd       int
+	dirs     map[int32]string            // watch descriptor -> dir
+	children map[int32]map[string]string // watch descriptor of a parent -> name -> dir
+}
+
+// watchDir watches dir. Masks are added, a dir can also be the parent
+// of another one.
+func (w *inotifyWatcher) watchDir(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask|syscall.IN_MASK_ADD)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// watchParent watches the parent of dir for dir being created or moved
+// in. It is not an error if the parent can't be watched.
+func (w *inotifyWatcher) watchParent(dir string) {
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, parent, inotifyParentMask|syscall.IN_MASK_ADD)
+	if err != nil {
+		return
+	}
+	m := w.children[int32(wd)]
+	if m == nil {
+		m = make(map[string]string)
+		w.children[int32(wd)] = m
+	}
+	m[filepath.Base(dir)] = dir
+}
+
+// handle handles an event. It reports whether files of watched dirs
+// may have been changed.
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) bool {
+	changed := false
+	if dir, ok := w.dirs[wd]; ok {
+		changed = true
+		if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+			// the old watch is removed by the kernel if the dir was
+			// deleted, remove it if the dir was moved away.
+			delete(w.dirs, wd)
+			if _, isParent := w.children[wd]; !isParent {
+				syscall.InotifyRmWatch(w.fd, uint32(wd))
+			}
+			// the path may already be a new dir, otherwise it will be
+			// watched when it appears in its parent.
+			w.watchDir(dir)
+		}
+	}
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && mask&syscall.IN_ISDIR != 0 {
+		if dir, ok := w.children[wd][name]; ok {
+			changed = true
+			w.watchDir(dir)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,186 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/Sirupsen/logrus"
+)
+
+func Test_listWatcher_check(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mos-chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domainFile := filepath.Join(dir, "domain.list")
+	ipFile := filepath.Join(dir, "ip.list")
+	write := func(file, data string, modTime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(domainFile, "a.com\n", now)
+	write(ipFile, "1.1.1.0/24\n", now)
+
+	w := newListWatcher(logrus.NewEntry(logrus.StandardLogger()), nil)
+	dl, err := w.domainList("domain", []string{domainFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	il, err := w.ipList("ip", []string{ipFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := ipv6.Conv(net.ParseIP("2.2.2.2"))
+
+	// unchanged
+	w.check()
+	if !dl.Has("a.com.") || dl.Has("b.com.") || il.Contains(ip) {
+		t.Fatal("lists should not be changed")
+	}
+
+	// changed
+	write(domainFile, "b.com\n", now.Add(time.Second))
+	write(ipFile, "2.2.2.0/24\n", now.Add(time.Second))
+	w.check()
+	if dl.Has("a.com.") || !dl.Has("b.com.") || !il.Contains(ip) {
+		t.Fatal("lists should be reloaded")
+	}
+
+	// broken files are ignored
+	write(ipFile, "not a cidr\n", now.Add(time.Second*2))
+	os.Remove(domainFile)
+	w.check()
+	if !dl.Has("b.com.") || !il.Contains(ip) {
+		t.Fatal("old lists should be kept")
+	}
+
+	// fixed
+	write(domainFile, "c.com\n", now.Add(time.Second*3))
+	w.check()
+	if !dl.Has("c.com.") {
+		t.Fatal("list should be reloaded after it was fixed")
+	}
+
+	// garbage and emptied files are ignored
+	for i, data := range []string{
+		"<html>\n<head><title>404 Not Found</title></head>\n<body>\n</body>\n</html>\n",
+		"c.com\n<html>\n<body>\n<h1>Not Found</h1>\n</body>\n",
+		"",
+		"# all entries were removed\n",
+	} {
+		write(domainFile, data, now.Add(time.Second*time.Duration(4+i)))
+		w.check()
+		if !dl.Has("c.com.") || dl.Len() != 1 {
+			t.Fatalf("old list should be kept after writing %q", data)
+		}
+	}
+}
+
+func Test_watchDirs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on linux")
+	}
+	dir, err := ioutil.TempDir("", "mos-chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	watched := filepath.Join(dir, "watched")
+	if err := os.Mkdir(watched, 0755); err != nil {
+		t.Fatal(err)
+	}
+	events, err := watchDirs([]string{watched})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case _, ok := <-events:
+			if !ok {
+				t.Fatalf("%s: watcher stopped", what)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s: no event received", what)
+		}
+		// drain events of the same change
+		time.Sleep(time.Millisecond * 50)
+		select {
+		case <-events:
+		default:
+		}
+	}
+
+	list := filepath.Join(watched, "list")
+	if err := ioutil.WriteFile(list, []byte("a.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wait("write")
+
+	// atomic replacement
+	tmp := filepath.Join(dir, "list.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("b.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, list); err != nil {
+		t.Fatal(err)
+	}
+	wait("rename")
+
+	if err := os.Symlink(list, filepath.Join(watched, "link")); err != nil {
+		t.Fatal(err)
+	}
+	wait("symlink")
+
+	// the dir itself is replaced, the new one should be watched
+	newDir := filepath.Join(dir, "new")
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(watched); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newDir, watched); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case <-events:
+	default:
+	}
+	if err := ioutil.WriteFile(list, []byte("c.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wait("write to the new dir")
+}
@@ -0,0 +1,248 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	hostsTTL            = 300
+	hostsReloadInterval = time.Second * 5
+
+	// the max length of a CNAME chain in local records
+	localRecordsMaxCNAME = 8
+)
+
+// localRecords answers queries with static records from the config
+// and hosts files. Hosts files are reloaded if they were modified.
+type localRecords struct {
+	inline []dns.RR
+	files  []string
+	entry  *logrus.Entry
+
+	sync.RWMutex
+	records  map[string][]dns.RR // lower case fqdn -> records
+	modTimes map[string]time.Time
+}
+
+// newLocalRecords parses inline records in zone file format, e.g.
+// "nas.lan. 300 IN A 192.168.1.2", and loads hosts files.
+func newLocalRecords(inline []string, files []string, entry *logrus.Entry) (*localRecords, error) {
+	lr := &localRecords{files: files, entry: entry}
+	for _, s := range inline {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("invalid record [%s], %v", s, err)
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypePTR:
+		default:
+			return nil, fmt.Errorf("unsupported record type of [%s]", s)
+		}
+		lr.inline = append(lr.inline, rr)
+	}
+	if err := lr.load(); err != nil {
+		return nil, err
+	}
+	return lr, nil
+}
+
+// load rebuilds records from inline records and hosts files.
+func (lr *localRecords) load() error {
+	records := make(map[string][]dns.RR)
+	modTimes := make(map[string]time.Time, len(lr.files))
+	add := func(rr dns.RR) {
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+
+	for _, rr := range lr.inline {
+		add(rr)
+	}
+	for _, file := range lr.files {
+		rrs, modTime, err := loadHostsFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to load hosts file %s, %w", file, err)
+		}
+		for _, rr := range rrs {
+			add(rr)
+		}
+		modTimes[file] = modTime
+	}
+
+	lr.Lock()
+	lr.records = records
+	lr.modTimes = modTimes
+	lr.Unlock()
+	return nil
+}
+
+// modified reports whether a hosts file was modified since last load.
+func (lr *localRecords) modified() bool {
+	lr.RLock()
+	defer lr.RUnlock()
+	for _, file := range lr.files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !stat.ModTime().Equal(lr.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadLoop reloads hosts files if they were modified.
+func (lr *localRecords) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !lr.modified() {
+			continue
+		}
+		if err := lr.load(); err != nil {
+			lr.entry.Warnf("reloadLoop: %v", err)
+			continue
+		}
+		lr.entry.Info("reloadLoop: hosts files reloaded")
+	}
+}
+
+// reply returns the reply of q, or nil if q's name is not in local records.
+// CNAMEs are followed within local records.
+func (lr *localRecords) reply(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+
+	lr.RLock()
+	defer lr.RUnlock()
+	name := strings.ToLower(question.Name)
+	rrs, ok := lr.records[name]
+	if !ok {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	for i := 0; i < localRecordsMaxCNAME; i++ {
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Class != question.Qclass {
+				continue
+			}
+			switch {
+			case hdr.Rrtype == question.Qtype:
+			case hdr.Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			default:
+				continue
+			}
+			rr = dns.Copy(rr)
+			if i == 0 {
+				// keep the case of the question
+				rr.Header().Name = question.Name
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		if cname == nil || question.Qtype == dns.TypeCNAME {
+			break
+		}
+		if rrs, ok = lr.records[strings.ToLower(cname.Target)]; !ok {
+			break
+		}
+	}
+	return r
+}
+
+// loadHostsFile loads a hosts file. Each line is "<ip> <name> [aliases...]".
+// A PTR record of the first name is synthesized for each ip.
+func loadHostsFile(file string) ([]dns.RR, time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var rrs []dns.RR
+	ptrs := make(map[string]struct{})
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: hostsTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := ptrs[reverse]; ok {
+			continue
+		}
+		if _, ok := dns.IsDomainName(fields[1]); !ok {
+			continue
+		}
+		ptrs[reverse] = struct{}{}
+		rrs = append(rrs, &dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hostsTTL},
+			Ptr: dns.Fqdn(fields[1]),
+		})
+	}
+	return rrs, stat.ModTime(), s.Err()
+}
@@ -0,0 +1,91 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+func Test_localRecords(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n192.168.1.2 nas.lan nas # inline comment\nfd00::1 router.lan\n")
+	f.Close()
+
+	lr, err := newLocalRecords([]string{
+		"www.lan. 300 IN CNAME nas.lan.",
+		"nas.lan. 300 IN TXT \"hello\"",
+	}, []string{f.Name()}, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		return lr.reply(q)
+	}
+
+	if r := query("NAS.lan.", dns.TypeA); r == nil || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 168, 1, 2)) || r.Answer[0].Header().Name != "NAS.lan." {
+		t.Fatal("invalid A answer")
+	}
+	if r := query("router.lan.", dns.TypeAAAA); r == nil || len(r.Answer) != 1 {
+		t.Fatal("invalid AAAA answer")
+	}
+	if r := query("router.lan.", dns.TypeA); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatal("want an empty answer")
+	}
+	if r := query("nas.lan.", dns.TypeTXT); r == nil || len(r.Answer) != 1 {
+		t.Fatal("invalid TXT answer")
+	}
+	if r := query("www.lan.", dns.TypeA); r == nil || len(r.Answer) != 2 || r.Answer[1].(*dns.A) == nil {
+		t.Fatal("CNAME should be followed")
+	}
+	if r := query("2.1.168.192.in-addr.arpa.", dns.TypePTR); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "nas.lan." {
+		t.Fatal("invalid PTR answer")
+	}
+	if r := query("example.com.", dns.TypeA); r != nil {
+		t.Fatal("unknown name should not be answered")
+	}
+
+	// reload
+	time.Sleep(time.Millisecond * 10)
+	if err := ioutil.WriteFile(f.Name(), []byte("192.168.1.3 nas.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Second))
+	if !lr.modified() {
+		t.Fatal("hosts file should be modified")
+	}
+	if err := lr.load(); err != nil {
+		t.Fatal(err)
+	}
+	if r := query("nas.lan.", dns.TypeA); r == nil || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 168, 1, 3)) {
+		t.Fatal("hosts file should be reloaded")
+	}
+}
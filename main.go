@@ -34,6 +34,8 @@ var (
 	dir                 = flag.String("dir", "", "[path] change working directory to here")
 	dirFollowExecutable = flag.Bool("dir2exe", false, "change working directory to the executable that started the current process")
 
+	compile = flag.Bool("compile", false, "compile lists in the config file to binary files, then exit")
+
 	verbose = flag.Bool("v", false, "more log")
 )
 
@@ -90,10 +92,24 @@ func main() {
 		entry.Fatalf("can not load config file, %v", err)
 	}
 
+	c.compileLists = *compile
 	d, err := initDispather(c, entry)
 	if err != nil {
 		entry.Fatal(err)
 	}
+	if *compile {
+		entry.Info("lists compiled")
+		return
+	}
+
+	if len(c.StatusAddr) != 0 {
+		go func() {
+			entry.Infof("status server started at %s", c.StatusAddr)
+			if err := d.ListenAndServeStatus(); err != nil {
+				entry.Errorf("status server exited with err: %v", err)
+			}
+		}()
+	}
 
 	go func() {
 		entry.Info("server started")
@@ -110,5 +126,7 @@ func main() {
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM)
 	s := <-osSignals
 	entry.Infof("exiting: signal: %v", s)
+	d.dumpCache()
+	d.dumpRouteMemory()
 	os.Exit(0)
 }
@@ -0,0 +1,201 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/miekg/dns"
+)
+
+// qtypeRouteSuffixPrivate restricts a qtype route to reverse
+// queries of private addresses, e.g. "PTR:private".
+const qtypeRouteSuffixPrivate = ":private"
+
+// qtypes that miekg/dns doesn't know yet
+var extraQtypes = map[string]uint16{
+	"SVCB":  64,
+	"HTTPS": 65,
+}
+
+// parseQtype parses a qtype name like "AAAA", "HTTPS" or "TYPE65".
+// It is case-insensitive.
+func parseQtype(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	if t, ok := extraQtypes[s]; ok {
+		return t, true
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		t, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+		return uint16(t), err == nil
+	}
+	return 0, false
+}
+
+// trimPrivateSuffix trims the case-insensitive ":private" suffix of a
+// qtype route and reports whether k has it.
+func trimPrivateSuffix(k string) (string, bool) {
+	n := len(k) - len(qtypeRouteSuffixPrivate)
+	if n >= 0 && strings.EqualFold(k[n:], qtypeRouteSuffixPrivate) {
+		return k[:n], true
+	}
+	return k, false
+}
+
+// newQtypeRoutes converts the qtype routing table to rules. Routes with
+// the ":private" suffix are placed before the plain routes of the same qtype.
+func newQtypeRoutes(table map[string]string) ([]*rule, error) {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		_, pi := trimPrivateSuffix(keys[i])
+		_, pj := trimPrivateSuffix(keys[j])
+		if pi != pj {
+			return pi
+		}
+		return keys[i] < keys[j]
+	})
+
+	rules := make([]*rule, 0, len(keys))
+	for _, k := range keys {
+		r := &rule{name: "qtype_routes[" + k + "]"}
+
+		s, private := trimPrivateSuffix(k)
+		r.privateReverse = private
+		t, ok := parseQtype(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype [%s]", k)
+		}
+		r.qtypes = map[uint16]struct{}{t: {}}
+
+		switch route := table[k]; route {
+		case "race":
+			r.action = actionRace
+		case "local":
+			r.action = actionLocal
+		case "remote":
+			r.action = actionRemote
+		case "empty":
+			r.action = actionStatic
+		case "refuse":
+			r.action = actionBlock
+			r.rcode = dns.RcodeRefused
+		default:
+			return nil, fmt.Errorf("invalid route [%s] of qtype [%s]", route, k)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// privateNets are the ranges that can't be resolved by public servers.
+var privateNets = func() *ipv6.NetList {
+	l := ipv6.NewNetList(nil)
+	for _, s := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		n, err := ipv6.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		l.Append(n)
+	}
+	l.Sort()
+	return l
+}()
+
+// isPrivateReverse reports whether q is a reverse query of a private address.
+func isPrivateReverse(q *dns.Msg) bool {
+	if len(q.Question) != 1 {
+		return false
+	}
+	ip := reverseNameToIP(q.Question[0].Name)
+	if ip == nil {
+		return false
+	}
+	ipv6Addr, err := ipv6.Conv(ip)
+	if err != nil {
+		return false
+	}
+	return privateNets.Contains(ipv6Addr)
+}
+
+// reverseNameToIP converts a full in-addr.arpa or ip6.arpa name to an IP.
+// It returns nil if name is not a reverse name of a single address.
+func reverseNameToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			if len(l) != 1 {
+				return nil
+			}
+			var n byte
+			switch c := l[0]; {
+			case c >= '0' && c <= '9':
+				n = c - '0'
+			case c >= 'a' && c <= 'f':
+				n = c - 'a' + 10
+			default:
+				return nil
+			}
+			// labels are in reverse nibble order
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= n << 4
+			} else {
+				ip[pos/2] |= n
+			}
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	"github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const defaultRewriteTTL = 300
+
+// rewrite answers matched queries with fixed IPs, or redirects them
+// to another name with a synthesized CNAME.
+type rewrite struct {
+	name    string
+	domains *domainlist.List // domains in the config
+	list    *domainList      // domain_list, can be nil
+
+	target string   // redirect target, a fqdn
+	ips    []net.IP // fixed IPs
+	ttl    uint32
+}
+
+func newRewrite(name string, conf *RewriteConfig, w *listWatcher) (*rewrite, error) {
+	rw := &rewrite{name: name, domains: domainlist.New(), ttl: defaultRewriteTTL}
+	if conf.TTL > 0 {
+		rw.ttl = uint32(conf.TTL)
+	}
+
+	for _, s := range conf.Domain {
+		if err := rw.domains.AddEntry(s); err != nil {
+			return nil, fmt.Errorf("invalid domain [%s], %w", s, err)
+		}
+	}
+	if len(conf.DomainList) != 0 {
+		l, err := w.domainList(name+".domain_list", []string{conf.DomainList})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain list, %w", err)
+		}
+		rw.list = l
+	}
+	if rw.domains.Len() == 0 && (rw.list == nil || rw.list.Len() == 0) {
+		return nil, errors.New("no domain")
+	}
+
+	switch {
+	case len(conf.To) != 0 && len(conf.IP) != 0:
+		return nil, errors.New("to and ip can not be both set")
+	case len(conf.To) != 0:
+		if _, ok := dns.IsDomainName(conf.To); !ok {
+			return nil, fmt.Errorf("invalid target [%s]", conf.To)
+		}
+		rw.target = dns.Fqdn(conf.To)
+	case len(conf.IP) != 0:
+		for _, s := range conf.IP {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip [%s]", s)
+			}
+			rw.ips = append(rw.ips, ip)
+		}
+	default:
+		return nil, errors.New("missing to or ip")
+	}
+	return rw, nil
+}
+
+// matchRewrite returns the first rewrite that q matches, or nil.
+func (d *dispatcher) matchRewrite(q *dns.Msg) *rewrite {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	for _, rw := range d.rewrites {
+		if name := q.Question[0].Name; rw.domains.Has(name) || (rw.list != nil && rw.list.Has(name)) {
+			return rw
+		}
+	}
+	return nil
+}
+
+// rewrite answers q by rw. r might be nil.
+func (d *dispatcher) rewrite(q *dns.Msg, info *requestInfo, rw *rewrite, requestLogger *logrus.Entry) *dns.Msg {
+	question := q.Question[0]
+
+	if len(rw.ips) != 0 {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for _, ip := range rw.ips {
+			hdr := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: rw.ttl}
+			switch ip4 := ip.To4(); {
+			case ip4 != nil && question.Qtype == dns.TypeA:
+				hdr.Rrtype = dns.TypeA
+				r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip4})
+			case ip4 == nil && question.Qtype == dns.TypeAAAA:
+				hdr.Rrtype = dns.TypeAAAA
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return r
+	}
+
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rw.ttl},
+		Target: rw.target,
+	}
+	if question.Qtype == dns.TypeCNAME {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{cname}
+		return r
+	}
+
+	requestLogger.Debugf("serveDNS: redirect to %s", rw.target)
+	rq := q.Copy()
+	rq.Question[0].Name = rw.target
+	res := d.resolve(rq, info, requestLogger)
+	if res == nil {
+		return nil
+	}
+
+	r := res.Copy()
+	r.Id = q.Id
+	r.Question = q.Question
+	r.Answer = append([]dns.RR{cname}, res.Answer...)
+	return r
+}
@@ -0,0 +1,223 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultRouteMemoryTTL             = time.Hour * 24
+	defaultRouteMemoryRecheckInterval = time.Hour
+	routeMemoryDumpInterval           = time.Minute * 10
+)
+
+// routeMemory remembers which upstream path answered each domain.
+// It is safe for concurrent use.
+type routeMemory struct {
+	size            int
+	ttl             time.Duration // entries that have not been used for ttl will be removed
+	recheckInterval time.Duration // entries that were learned before recheckInterval need a recheck
+
+	sync.Mutex
+	m map[string]*routeMemoryEntry
+}
+
+type routeMemoryEntry struct {
+	path        string
+	learnedTime time.Time
+	usedTime    time.Time
+}
+
+func newRouteMemory(size int, ttl, recheckInterval time.Duration) *routeMemory {
+	return &routeMemory{
+		size:            size,
+		ttl:             ttl,
+		recheckInterval: recheckInterval,
+		m:               make(map[string]*routeMemoryEntry),
+	}
+}
+
+// lookup returns the path that answered domain. If domain is unknown or
+// it's time to recheck it, lookup returns an empty string.
+func (m *routeMemory) lookup(domain string) string {
+	domain = strings.ToLower(domain)
+	now := time.Now()
+
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.m[domain]
+	if !ok {
+		return ""
+	}
+	if now.Sub(e.usedTime) > m.ttl {
+		delete(m.m, domain)
+		return ""
+	}
+	if now.Sub(e.learnedTime) > m.recheckInterval {
+		return ""
+	}
+	e.usedTime = now
+	return e.path
+}
+
+// learn records that path answered domain.
+func (m *routeMemory) learn(domain, path string) {
+	m.add(strings.ToLower(domain), path, time.Now())
+}
+
+func (m *routeMemory) add(domain, path string, t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	if e, ok := m.m[domain]; ok {
+		e.path = path
+		e.learnedTime = t
+		e.usedTime = t
+		return
+	}
+
+	if len(m.m) >= m.size {
+		m.evict()
+	}
+	m.m[domain] = &routeMemoryEntry{path: path, learnedTime: t, usedTime: t}
+}
+
+// evict removes expired entries. If the memory is still full, it removes
+// some random entries. Caller must hold the lock.
+func (m *routeMemory) evict() {
+	now := time.Now()
+	for domain, e := range m.m {
+		if now.Sub(e.usedTime) > m.ttl {
+			delete(m.m, domain)
+		}
+	}
+
+	toRemove := len(m.m) - m.size + m.size/8 + 1
+	for domain := range m.m {
+		if toRemove <= 0 {
+			break
+		}
+		delete(m.m, domain)
+		toRemove--
+	}
+}
+
+func (m *routeMemory) len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.m)
+}
+
+// writeTable writes a human readable table of the memory to w.
+func (m *routeMemory) writeTable(w io.Writer) error {
+	type row struct {
+		domain string
+		e      routeMemoryEntry
+	}
+
+	m.Lock()
+	rows := make([]row, 0, len(m.m))
+	for domain, e := range m.m {
+		rows = append(rows, row{domain: domain, e: *e})
+	}
+	m.Unlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].domain < rows[j].domain })
+
+	now := time.Now()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %d entries\n", len(rows))
+	fmt.Fprintf(bw, "# domain\tpath\tlearned\tidle\n")
+	for _, r := range rows {
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\n", r.domain, r.e.path,
+			r.e.learnedTime.Format(time.RFC3339), now.Sub(r.e.usedTime).Truncate(time.Second))
+	}
+	return bw.Flush()
+}
+
+// dumpDomains writes domains answered by path to file as a domain list.
+// The file is replaced atomically.
+func (m *routeMemory) dumpDomains(file, path string) (int, error) {
+	m.Lock()
+	domains := make([]string, 0, len(m.m))
+	for domain, e := range m.m {
+		if e.path == path {
+			domains = append(domains, domain)
+		}
+	}
+	m.Unlock()
+	sort.Strings(domains)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	fmt.Fprintf(bw, "# domains learned by mos-chinadns route memory, path: %s\n", path)
+	for _, domain := range domains {
+		bw.WriteString(strings.TrimSuffix(domain, "."))
+		bw.WriteByte('\n')
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(domains), os.Rename(tmp.Name(), file)
+}
+
+// loadDomains loads a domain list written by dumpDomains, all domains
+// in the file will be learned as answered by path.
+func (m *routeMemory) loadDomains(file, path string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := dns.IsDomainName(line); !ok {
+			return n, fmt.Errorf("invaild domain [%s]", line)
+		}
+		m.add(strings.ToLower(dns.Fqdn(line)), path, now)
+		n++
+	}
+	return n, s.Err()
+}
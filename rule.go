@@ -0,0 +1,235 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/core/ipv6"
+	"github.com/miekg/dns"
+)
+
+type ruleAction int
+
+// rule actions
+const (
+	actionRace     ruleAction = iota // query both local and remote server, the default action
+	actionLocal                      // query local server only, its result won't be dropped
+	actionRemote                     // query remote server only
+	actionBlock                      // reply with an rcode
+	actionStatic                     // reply with static records
+	actionUpstream                   // query a named upstream only
+)
+
+var ruleActionNames = map[string]ruleAction{
+	"race":     actionRace,
+	"local":    actionLocal,
+	"remote":   actionRemote,
+	"block":    actionBlock,
+	"static":   actionStatic,
+	"upstream": actionUpstream,
+}
+
+// requestInfo describes where a query came from. Its fields can be empty
+// if unknown.
+type requestInfo struct {
+	clientIP net.IP
+	listener string
+}
+
+// rule is a routing rule. A query matches a rule if it matches all
+// of its non-empty matchers.
+type rule struct {
+	id   int
+	name string
+
+	// matchers
+	domains        *domainList
+	qtypes         map[uint16]struct{}
+	clientNets     *ipv6.NetList
+	listeners      map[string]struct{}
+	unusualType    bool // matches queries that isUnusualType
+	privateReverse bool // matches queries that isPrivateReverse
+
+	action   ruleAction
+	upstream *upstream
+	rcode    int
+	answer   []dns.RR
+}
+
+func newRule(name string, conf *RuleConfig, upstreams map[string]*upstream, w *listWatcher) (*rule, error) {
+	r := &rule{name: name}
+
+	if len(conf.DomainList) != 0 {
+		dl, err := w.domainList(name+".domain_list", []string{conf.DomainList})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain list, %w", err)
+		}
+		r.domains = dl
+	}
+
+	if len(conf.Qtype) != 0 {
+		r.qtypes = make(map[uint16]struct{}, len(conf.Qtype))
+		for _, s := range conf.Qtype {
+			t, ok := parseQtype(s)
+			if !ok {
+				return nil, fmt.Errorf("invalid qtype [%s]", s)
+			}
+			r.qtypes[t] = struct{}{}
+		}
+	}
+
+	if len(conf.ClientSubnet) != 0 {
+		r.clientNets = ipv6.NewNetList(make([]ipv6.Net, 0, len(conf.ClientSubnet)))
+		for _, s := range conf.ClientSubnet {
+			n, err := ipv6.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client subnet [%s], %w", s, err)
+			}
+			r.clientNets.Append(n)
+		}
+		r.clientNets.Sort()
+	}
+
+	if len(conf.Listener) != 0 {
+		r.listeners = make(map[string]struct{}, len(conf.Listener))
+		for _, s := range conf.Listener {
+			r.listeners[s] = struct{}{}
+		}
+	}
+
+	action, ok := ruleActionNames[conf.Action]
+	if !ok {
+		return nil, fmt.Errorf("invalid action [%s]", conf.Action)
+	}
+	r.action = action
+
+	switch action {
+	case actionUpstream:
+		u, ok := upstreams[conf.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream [%s]", conf.Upstream)
+		}
+		r.upstream = u
+	case actionBlock:
+		r.rcode = dns.RcodeNameError
+		if len(conf.Rcode) != 0 {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(conf.Rcode)]
+			if !ok {
+				return nil, fmt.Errorf("invalid rcode [%s]", conf.Rcode)
+			}
+			r.rcode = rcode
+		}
+	case actionStatic:
+		for _, s := range conf.Answer {
+			rr, err := dns.NewRR(". " + s)
+			if err != nil || rr == nil {
+				return nil, fmt.Errorf("invalid answer [%s], %v", s, err)
+			}
+			r.answer = append(r.answer, rr)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *rule) match(q *dns.Msg, info *requestInfo) bool {
+	if r.domains != nil && !inDomainList(q, r.domains) {
+		return false
+	}
+
+	if r.qtypes != nil {
+		if len(q.Question) != 1 {
+			return false
+		}
+		if _, ok := r.qtypes[q.Question[0].Qtype]; !ok {
+			return false
+		}
+	}
+
+	if r.clientNets != nil {
+		if info == nil || info.clientIP == nil {
+			return false
+		}
+		ip, err := ipv6.Conv(info.clientIP)
+		if err != nil || !r.clientNets.Contains(ip) {
+			return false
+		}
+	}
+
+	if r.listeners != nil {
+		if info == nil {
+			return false
+		}
+		if _, ok := r.listeners[info.listener]; !ok {
+			return false
+		}
+	}
+
+	if r.unusualType && !isUnusualType(q) {
+		return false
+	}
+
+	if r.privateReverse && !isPrivateReverse(q) {
+		return false
+	}
+
+	return true
+}
+
+// reply returns the reply of q if r's action is block or static.
+func (r *rule) reply(q *dns.Msg) *dns.Msg {
+	res := new(dns.Msg)
+	switch r.action {
+	case actionBlock:
+		res.SetRcode(q, r.rcode)
+	case actionStatic:
+		res.SetReply(q)
+		if len(q.Question) != 1 {
+			break
+		}
+		question := q.Question[0]
+		for _, rr := range r.answer {
+			hdr := rr.Header()
+			if hdr.Class != question.Qclass || (hdr.Rrtype != question.Qtype && hdr.Rrtype != dns.TypeCNAME) {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			res.Answer = append(res.Answer, rr)
+		}
+	}
+	return res
+}
+
+// matchRule returns the first rule that q matches, or nil.
+// If g is not nil, the rules of g are used.
+func (d *dispatcher) matchRule(q *dns.Msg, info *requestInfo, g *clientGroup) *rule {
+	rules := d.rules
+	if g != nil {
+		rules = g.rules
+	}
+	for _, r := range rules {
+		if r.match(q, info) {
+			return r
+		}
+	}
+	return nil
+}
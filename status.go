@@ -0,0 +1,45 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+)
+
+// ListenAndServeStatus starts a http server that shows the
+// internal status of the dispatcher in plain text.
+func (d *dispatcher) ListenAndServeStatus() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/route_memory", d.handleRouteMemory)
+	mux.HandleFunc("/blocklists", d.handleBlocklists)
+	return http.ListenAndServe(d.statusAddr, mux)
+}
+
+func (d *dispatcher) handleRouteMemory(w http.ResponseWriter, req *http.Request) {
+	if d.routeMemory == nil {
+		http.Error(w, "route memory is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	d.routeMemory.writeTable(w)
+}
+
+func (d *dispatcher) handleBlocklists(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	d.writeBlocklistHits(w)
+}
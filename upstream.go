@@ -0,0 +1,125 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/domainlist"
+	dohClient "github.com/IrineSistiana/mos-doh-client/client"
+	"github.com/miekg/dns"
+)
+
+// upstream is a named upstream server.
+type upstream struct {
+	name    string
+	addr    string
+	timeout time.Duration
+
+	client    *dns.Client
+	dohClient *dohClient.DohClient
+}
+
+func newUpstream(name string, conf *UpstreamConfig) (*upstream, error) {
+	if len(conf.Addr) == 0 {
+		return nil, errors.New("missing addr")
+	}
+
+	u := &upstream{
+		name:    name,
+		addr:    conf.Addr,
+		timeout: queryTimeout,
+	}
+	if conf.Timeout > 0 {
+		u.timeout = time.Millisecond * time.Duration(conf.Timeout)
+	}
+
+	switch conf.Protocol {
+	case "", "udp", "tcp":
+		u.client = &dns.Client{Net: conf.Protocol, Timeout: u.timeout}
+	case "tls":
+		host, _, err := net.SplitHostPort(conf.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid addr [%s], %w", conf.Addr, err)
+		}
+		serverName := conf.ServerName
+		if len(serverName) == 0 {
+			serverName = host
+		}
+		u.client = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   u.timeout,
+			TLSConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: conf.SkipVerify},
+		}
+	case "doh":
+		if len(conf.URL) == 0 {
+			return nil, errors.New("missing url")
+		}
+		u.dohClient = dohClient.NewClient(conf.URL, conf.Addr, conf.SkipVerify, 2048, u.timeout)
+	default:
+		return nil, fmt.Errorf("unsupported protocol [%s]", conf.Protocol)
+	}
+	return u, nil
+}
+
+// newForwardZone returns a rule that forwards queries in conf.Zones and their
+// subdomains to an upstream, bypassing the local/remote race.
+func newForwardZone(name string, conf *ForwardZoneConfig, upstreams map[string]*upstream) (*rule, error) {
+	if len(conf.Zones) == 0 {
+		return nil, errors.New("missing zones")
+	}
+	zones := domainlist.New()
+	for _, zone := range conf.Zones {
+		if err := zones.Add(zone); err != nil {
+			return nil, fmt.Errorf("invalid zone [%s], %w", zone, err)
+		}
+	}
+	r := &rule{name: name, domains: newDomainList(zones), action: actionUpstream}
+
+	if len(conf.Upstream) != 0 {
+		u, ok := upstreams[conf.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream [%s]", conf.Upstream)
+		}
+		r.upstream = u
+		return r, nil
+	}
+	u, err := newUpstream(name, &conf.UpstreamConfig)
+	if err != nil {
+		return nil, err
+	}
+	r.upstream = u
+	return r, nil
+}
+
+func (u *upstream) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if u.dohClient != nil {
+		t := time.Now()
+		r, err := u.dohClient.Exchange(q)
+		return r, time.Since(t), err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	return u.client.ExchangeContext(ctx, q, u.addr)
+}